@@ -0,0 +1,174 @@
+// Copyright © 2020 Ulrich Anhalt <ulrich.anhalt@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// characters, which are not allowed in a node of a graphite path
+var graphiteNodeRE = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// placeholders {metric} and {<label>} of the graphite path template
+var graphitePlaceholderRE = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// GraphiteSink - collect the metrics at every tick and send them to the carbon endpoint
+func (config *Config) GraphiteSink(tick <-chan time.Time) {
+	for now := range tick {
+		err := config.PushGraphite(GraphiteLines(config.stats(), config.GraphiteTemplate, now))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"endpoint": config.GraphiteEndpoint,
+				"error":    err,
+			}).Error("Can't push metrics to carbon endpoint.")
+		}
+	}
+}
+
+// PushGraphite - send the lines in graphite plaintext format to the carbon endpoint
+func (config *Config) PushGraphite(lines []string) error {
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", config.GraphiteEndpoint, timeout)
+	if err != nil {
+		return errors.Wrap(err, "PushGraphite(DialTimeout)")
+	}
+	defer conn.Close()
+
+	err = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return errors.Wrap(err, "PushGraphite(SetWriteDeadline)")
+	}
+
+	_, err = conn.Write([]byte(strings.Join(lines, "")))
+	if err != nil {
+		return errors.Wrap(err, "PushGraphite(Write)")
+	}
+	return nil
+}
+
+// ValidateGraphiteTemplate - the path template must contain the metric name
+func ValidateGraphiteTemplate(template string) error {
+	if !strings.Contains(template, "{metric}") {
+		return errors.Errorf("ValidateGraphiteTemplate(%s contains no {metric})", template)
+	}
+	return nil
+}
+
+// GraphiteLines - convert the collected metrics into lines of the graphite
+// plaintext format "<path> <value> <timestamp>". Histograms and summaries get
+// the paths of the prometheus series, i.e. <metric>_bucket with the le label,
+// <metric> with the quantile label, <metric>_sum and <metric>_count. Records
+// with time column keep their time, the others get the time of the push.
+func GraphiteLines(stats []MetricData, template string, now time.Time) []string {
+
+	var lines []string
+	for _, mi := range stats {
+		for _, v := range mi.Stats {
+			name := v.MetricName(mi.Name)
+			ts := now
+			if !v.Timestamp.IsZero() {
+				ts = v.Timestamp
+			}
+			line := func(name string, labels, values []string, value float64) {
+				lines = append(lines, graphitePath(template, name, labels, values)+" "+
+					strconv.FormatFloat(value, 'f', -1, 64)+" "+
+					strconv.FormatInt(ts.Unix(), 10)+"\n")
+			}
+			with := func(label, value string) ([]string, []string) {
+				return append(append([]string(nil), v.Labels...), label), append(append([]string(nil), v.LabelValues...), value)
+			}
+
+			switch {
+			case nil != v.Histogram:
+				bounds := make([]float64, 0, len(v.Histogram.Buckets))
+				for le := range v.Histogram.Buckets {
+					if !math.IsInf(le, 1) {
+						bounds = append(bounds, le)
+					}
+				}
+				sort.Float64s(bounds)
+				for _, le := range bounds {
+					labels, values := with("le", strconv.FormatFloat(le, 'f', -1, 64))
+					line(name+"_bucket", labels, values, float64(v.Histogram.Buckets[le]))
+				}
+				labels, values := with("le", "+Inf")
+				line(name+"_bucket", labels, values, float64(v.Histogram.Count))
+				line(name+"_sum", v.Labels, v.LabelValues, v.Histogram.Sum)
+				line(name+"_count", v.Labels, v.LabelValues, float64(v.Histogram.Count))
+			case nil != v.Summary:
+				quantiles := make([]float64, 0, len(v.Summary.Quantiles))
+				for q := range v.Summary.Quantiles {
+					quantiles = append(quantiles, q)
+				}
+				sort.Float64s(quantiles)
+				for _, q := range quantiles {
+					labels, values := with("quantile", strconv.FormatFloat(q, 'f', -1, 64))
+					line(name, labels, values, v.Summary.Quantiles[q])
+				}
+				line(name+"_sum", v.Labels, v.LabelValues, v.Summary.Sum)
+				line(name+"_count", v.Labels, v.LabelValues, float64(v.Summary.Count))
+			default:
+				line(name, v.Labels, v.LabelValues, v.Value)
+			}
+		}
+	}
+	return lines
+}
+
+// path of a record: the placeholders of the template are replaced by the
+// metric name and the label values, the values of the labels not contained
+// in the template are appended, so that the paths of a metric stay unique
+func graphitePath(template, name string, labels, values []string) string {
+
+	used := make(map[string]bool)
+	path := graphitePlaceholderRE.ReplaceAllStringFunc(template, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		if "metric" == key {
+			return graphiteNode(name)
+		}
+		for i, label := range labels {
+			if label == key && i < len(values) {
+				used[label] = true
+				return graphiteNode(values[i])
+			}
+		}
+		return "unknown"
+	})
+
+	for i, label := range labels {
+		if !used[label] && i < len(values) {
+			path += "." + graphiteNode(values[i])
+		}
+	}
+	return path
+}
+
+// node of a graphite path without dots and spaces
+func graphiteNode(value string) string {
+	if "" == value {
+		return "none"
+	}
+	return graphiteNodeRE.ReplaceAllString(value, "_")
+}
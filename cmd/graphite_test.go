@@ -0,0 +1,98 @@
+package cmd_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func Test_GraphiteSink(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return []cmd.MetricRecord{{Value: 2.5, Labels: []string{"tenant", "usage", "host"}, LabelValues: []string{"d01", "production", "hana.example.com"}}}
+	}
+
+	// stub carbon listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+	config.GraphiteEndpoint = listener.Addr().String()
+	config.GraphiteTemplate = "hana.{tenant}.{metric}"
+
+	now := time.Unix(1600000000, 0)
+	tick := make(chan time.Time, 1)
+	tick <- now
+	close(tick)
+	config.GraphiteSink(tick)
+
+	lines := <-received
+	assert.Contains(lines, "hana.d01.m1.production.hana_example_com 2.5 1600000000")
+	assert.Contains(lines, "hana.d01.hana_sql_exporter_tenant_up 1 1600000000")
+
+	// unreachable endpoint
+	listener.Close()
+	assert.Error(config.PushGraphite(lines))
+}
+
+func Test_GraphiteLines(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := []cmd.MetricData{{
+		Name: "hdb_info",
+		Stats: []cmd.MetricRecord{
+			{Value: 1, Labels: []string{"tenant", "schema"}, LabelValues: []string{"d01", ""}},
+			{Value: 0.25, Labels: []string{"tenant"}, LabelValues: []string{"d02"}, Prefix: "p02"},
+		},
+	}}
+	lines := cmd.GraphiteLines(stats, "{metric}.{tenant}.{missing}", time.Unix(10, 0))
+	assert.Equal([]string{
+		"hdb_info.d01.unknown.none 1 10\n",
+		"p02_hdb_info.d02.unknown 0.25 10\n",
+	}, lines)
+
+	// histograms and summaries get the paths of the prometheus series, the
+	// record keeps its time
+	stats = []cmd.MetricData{{
+		Name: "hdb_wait",
+		Stats: []cmd.MetricRecord{
+			{Value: 6, Labels: []string{"tenant"}, LabelValues: []string{"d01"}, Timestamp: time.Unix(5, 0), Histogram: &cmd.HistogramData{Buckets: map[float64]uint64{2.5: 4, 1: 1}, Count: 6, Sum: 3.5}},
+			{Value: 3, Labels: []string{"tenant"}, LabelValues: []string{"d02"}, Summary: &cmd.SummaryData{Quantiles: map[float64]float64{0.9: 8, 0.5: 2}, Count: 3, Sum: 12}},
+		},
+	}}
+	lines = cmd.GraphiteLines(stats, "{metric}.{tenant}", time.Unix(10, 0))
+	assert.Equal([]string{
+		"hdb_wait_bucket.d01.1 1 5\n",
+		"hdb_wait_bucket.d01.2_5 4 5\n",
+		"hdb_wait_bucket.d01._Inf 6 5\n",
+		"hdb_wait_sum.d01 3.5 5\n",
+		"hdb_wait_count.d01 6 5\n",
+		"hdb_wait.d02.0_5 2 10\n",
+		"hdb_wait.d02.0_9 8 10\n",
+		"hdb_wait_sum.d02 12 10\n",
+		"hdb_wait_count.d02 3 10\n",
+	}, lines)
+
+	// the template needs the metric name
+	assert.NoError(cmd.ValidateGraphiteTemplate("hana.{tenant}.{metric}"))
+	assert.Error(cmd.ValidateGraphiteTemplate("hana.{tenant}"))
+}
@@ -0,0 +1,308 @@
+// Copyright © 2020 Ulrich Anhalt <ulrich.anhalt@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// cumulative aggregation temporality of otlp sums
+const otlpCumulative = 2
+
+// OTLPRequest - otlp/http json export request of metrics
+type OTLPRequest struct {
+	ResourceMetrics []OTLPResourceMetrics `json:"resourceMetrics"`
+}
+
+// OTLPResourceMetrics - metrics of the exporter as resource
+type OTLPResourceMetrics struct {
+	Resource     OTLPResource       `json:"resource"`
+	ScopeMetrics []OTLPScopeMetrics `json:"scopeMetrics"`
+}
+
+// OTLPResource - attributes of the exporter
+type OTLPResource struct {
+	Attributes []OTLPAttribute `json:"attributes"`
+}
+
+// OTLPScopeMetrics - metrics of the instrumentation scope
+type OTLPScopeMetrics struct {
+	Scope   OTLPScope    `json:"scope"`
+	Metrics []OTLPMetric `json:"metrics"`
+}
+
+// OTLPScope - instrumentation scope
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+// OTLPMetric - one metric, either gauge, sum, histogram or summary
+type OTLPMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *OTLPGauge     `json:"gauge,omitempty"`
+	Sum         *OTLPSum       `json:"sum,omitempty"`
+	Histogram   *OTLPHistogram `json:"histogram,omitempty"`
+	Summary     *OTLPSummary   `json:"summary,omitempty"`
+}
+
+// OTLPGauge - data points of a gauge
+type OTLPGauge struct {
+	DataPoints []OTLPDataPoint `json:"dataPoints"`
+}
+
+// OTLPSum - data points of a counter
+type OTLPSum struct {
+	DataPoints             []OTLPDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+// OTLPDataPoint - value with the labels as attributes
+type OTLPDataPoint struct {
+	Attributes   []OTLPAttribute `json:"attributes,omitempty"`
+	TimeUnixNano uint64          `json:"timeUnixNano,string"`
+	AsDouble     float64         `json:"asDouble"`
+}
+
+// OTLPHistogram - data points of a histogram
+type OTLPHistogram struct {
+	DataPoints             []OTLPHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+// OTLPHistogramDataPoint - counts of the buckets between the explicit bounds
+// and above the last one with the labels as attributes
+type OTLPHistogramDataPoint struct {
+	Attributes     []OTLPAttribute `json:"attributes,omitempty"`
+	TimeUnixNano   uint64          `json:"timeUnixNano,string"`
+	Count          uint64          `json:"count,string"`
+	Sum            float64         `json:"sum"`
+	BucketCounts   []uint64        `json:"bucketCounts"`
+	ExplicitBounds []float64       `json:"explicitBounds"`
+}
+
+// OTLPSummary - data points of a summary
+type OTLPSummary struct {
+	DataPoints []OTLPSummaryDataPoint `json:"dataPoints"`
+}
+
+// OTLPSummaryDataPoint - quantiles of a summary with the labels as attributes
+type OTLPSummaryDataPoint struct {
+	Attributes     []OTLPAttribute     `json:"attributes,omitempty"`
+	TimeUnixNano   uint64              `json:"timeUnixNano,string"`
+	Count          uint64              `json:"count,string"`
+	Sum            float64             `json:"sum"`
+	QuantileValues []OTLPQuantileValue `json:"quantileValues"`
+}
+
+// OTLPQuantileValue - value of a quantile
+type OTLPQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// OTLPAttribute - string attribute
+type OTLPAttribute struct {
+	Key   string             `json:"key"`
+	Value OTLPAttributeValue `json:"value"`
+}
+
+// OTLPAttributeValue - value of a string attribute
+type OTLPAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// OTLPPush - collect the metrics at every tick and push them to the otlp endpoint
+func (config *Config) OTLPPush(tick <-chan time.Time) {
+	for now := range tick {
+		err := config.PushOTLP(NewOTLPRequest(config.stats(), now))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"endpoint": config.OTLPEndpoint,
+				"error":    err,
+			}).Error("Can't push metrics to otlp endpoint.")
+		}
+	}
+}
+
+// PushOTLP - send the export request to the otlp/http endpoint
+func (config *Config) PushOTLP(req OTLPRequest) error {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "PushOTLP(Marshal)")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, config.OTLPEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "PushOTLP(NewRequest)")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "PushOTLP(Do)")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("PushOTLP(status %d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// NewOTLPRequest - convert the collected metrics into an otlp export request.
+// Gauges become otlp gauges, counters cumulative monotonic sums, histograms
+// cumulative histograms and summaries otlp summaries. Records of tenants with
+// metric prefix get their own metric like in the prometheus output. Records
+// with time column keep their time, the others get the time of the push.
+func NewOTLPRequest(stats []MetricData, now time.Time) OTLPRequest {
+
+	var metrics []OTLPMetric
+	for _, mi := range stats {
+
+		// one otlp metric per metric name in the order of appearance
+		pos := make(map[string]int)
+		for _, v := range mi.Stats {
+			name := v.MetricName(mi.Name)
+
+			i, ok := pos[name]
+			if !ok {
+				i = len(metrics)
+				pos[name] = i
+				metric := OTLPMetric{
+					Name:        name,
+					Description: mi.Help,
+				}
+				switch {
+				case nil != v.Histogram:
+					metric.Histogram = &OTLPHistogram{AggregationTemporality: otlpCumulative}
+				case nil != v.Summary:
+					metric.Summary = &OTLPSummary{}
+				case "counter" == low(mi.MetricType):
+					metric.Sum = &OTLPSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+				default:
+					metric.Gauge = &OTLPGauge{}
+				}
+				metrics = append(metrics, metric)
+			}
+
+			var attributes []OTLPAttribute
+			for j, label := range v.Labels {
+				if j < len(v.LabelValues) {
+					attributes = append(attributes, OTLPAttribute{Key: label, Value: OTLPAttributeValue{StringValue: v.LabelValues[j]}})
+				}
+			}
+			ts := now
+			if !v.Timestamp.IsZero() {
+				ts = v.Timestamp
+			}
+
+			switch {
+			case nil != metrics[i].Histogram && nil != v.Histogram:
+				metrics[i].Histogram.DataPoints = append(metrics[i].Histogram.DataPoints, otlpHistogramPoint(v.Histogram, attributes, ts))
+			case nil != metrics[i].Summary && nil != v.Summary:
+				metrics[i].Summary.DataPoints = append(metrics[i].Summary.DataPoints, otlpSummaryPoint(v.Summary, attributes, ts))
+			case nil != metrics[i].Histogram || nil != metrics[i].Summary || nil != v.Histogram || nil != v.Summary:
+				log.WithFields(log.Fields{
+					"metric": name,
+				}).Debug("Record doesn't match the type of the otlp metric - skipped.")
+			case nil != metrics[i].Sum:
+				metrics[i].Sum.DataPoints = append(metrics[i].Sum.DataPoints, OTLPDataPoint{Attributes: attributes, TimeUnixNano: uint64(ts.UnixNano()), AsDouble: v.Value})
+			default:
+				metrics[i].Gauge.DataPoints = append(metrics[i].Gauge.DataPoints, OTLPDataPoint{Attributes: attributes, TimeUnixNano: uint64(ts.UnixNano()), AsDouble: v.Value})
+			}
+		}
+	}
+
+	return OTLPRequest{
+		ResourceMetrics: []OTLPResourceMetrics{
+			{
+				Resource: OTLPResource{
+					Attributes: []OTLPAttribute{{Key: "service.name", Value: OTLPAttributeValue{StringValue: "hana_sql_exporter"}}},
+				},
+				ScopeMetrics: []OTLPScopeMetrics{
+					{
+						Scope:   OTLPScope{Name: "hana_sql_exporter"},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlp histogram point of the cumulative prometheus buckets: the otlp bucket
+// counts are the counts between the bounds and the last one the count above
+// the largest bound
+func otlpHistogramPoint(h *HistogramData, attributes []OTLPAttribute, ts time.Time) OTLPHistogramDataPoint {
+	bounds := make([]float64, 0, len(h.Buckets))
+	for le := range h.Buckets {
+		if !math.IsInf(le, 1) {
+			bounds = append(bounds, le)
+		}
+	}
+	sort.Float64s(bounds)
+
+	counts := make([]uint64, 0, len(bounds)+1)
+	var last uint64
+	for _, le := range bounds {
+		counts = append(counts, h.Buckets[le]-last)
+		last = h.Buckets[le]
+	}
+	counts = append(counts, h.Count-last)
+
+	return OTLPHistogramDataPoint{
+		Attributes:     attributes,
+		TimeUnixNano:   uint64(ts.UnixNano()),
+		Count:          h.Count,
+		Sum:            h.Sum,
+		BucketCounts:   counts,
+		ExplicitBounds: bounds,
+	}
+}
+
+// otlp summary point with the quantiles in ascending order
+func otlpSummaryPoint(sm *SummaryData, attributes []OTLPAttribute, ts time.Time) OTLPSummaryDataPoint {
+	quantiles := make([]float64, 0, len(sm.Quantiles))
+	for q := range sm.Quantiles {
+		quantiles = append(quantiles, q)
+	}
+	sort.Float64s(quantiles)
+
+	point := OTLPSummaryDataPoint{
+		Attributes:   attributes,
+		TimeUnixNano: uint64(ts.UnixNano()),
+		Count:        sm.Count,
+		Sum:          sm.Sum,
+	}
+	for _, q := range quantiles {
+		point.QuantileValues = append(point.QuantileValues, OTLPQuantileValue{Quantile: q, Value: sm.Quantiles[q]})
+	}
+	return point
+}
@@ -0,0 +1,158 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func Test_OTLPPush(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 1)
+	config.Metrics[1].MetricType = "counter"
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return []cmd.MetricRecord{{Value: 2.5, Labels: []string{"tenant", "usage"}, LabelValues: []string{"d01", "production"}}}
+	}
+
+	// stub otlp receiver
+	received := make(chan cmd.OTLPRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+
+		var req cmd.OTLPRequest
+		assert.NoError(json.NewDecoder(r.Body).Decode(&req))
+		received <- req
+	}))
+	defer receiver.Close()
+	config.OTLPEndpoint = receiver.URL + "/v1/metrics"
+
+	now := time.Unix(1600000000, 0)
+	tick := make(chan time.Time, 1)
+	tick <- now
+	close(tick)
+	config.OTLPPush(tick)
+
+	req := <-received
+	assert.Equal(1, len(req.ResourceMetrics))
+	assert.Equal("hana_sql_exporter", req.ResourceMetrics[0].Resource.Attributes[0].Value.StringValue)
+	metrics := make(map[string]cmd.OTLPMetric)
+	for _, metric := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	// gauge
+	m1 := metrics["m1"]
+	assert.Equal("h1", m1.Description)
+	assert.Nil(m1.Sum)
+	assert.Equal([]cmd.OTLPDataPoint{{
+		Attributes: []cmd.OTLPAttribute{
+			{Key: "tenant", Value: cmd.OTLPAttributeValue{StringValue: "d01"}},
+			{Key: "usage", Value: cmd.OTLPAttributeValue{StringValue: "production"}},
+		},
+		TimeUnixNano: uint64(now.UnixNano()),
+		AsDouble:     2.5,
+	}}, m1.Gauge.DataPoints)
+
+	// counter
+	m2 := metrics["m2"]
+	assert.Nil(m2.Gauge)
+	assert.True(m2.Sum.IsMonotonic)
+	assert.Equal(2, m2.Sum.AggregationTemporality)
+	assert.Equal(2.5, m2.Sum.DataPoints[0].AsDouble)
+
+	// exporter metrics are pushed as well
+	assert.Equal(1.0, metrics["hana_sql_exporter_tenant_up"].Gauge.DataPoints[0].AsDouble)
+
+	// failing receiver
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	config.OTLPEndpoint = failing.URL
+	assert.Error(config.PushOTLP(cmd.NewOTLPRequest(nil, now)))
+}
+
+func Test_NewOTLPRequestPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	// records with prefix get their own metric
+	req := cmd.NewOTLPRequest([]cmd.MetricData{{
+		Name:       "hdb_info",
+		MetricType: "gauge",
+		Stats: []cmd.MetricRecord{
+			{Value: 1},
+			{Value: 2, Prefix: "p01"},
+			{Value: 3},
+		},
+	}}, time.Now())
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(2, len(metrics))
+	assert.Equal("hdb_info", metrics[0].Name)
+	assert.Equal(2, len(metrics[0].Gauge.DataPoints))
+	assert.Equal("p01_hdb_info", metrics[1].Name)
+	assert.Equal(2.0, metrics[1].Gauge.DataPoints[0].AsDouble)
+}
+
+func Test_NewOTLPRequest(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1600000000, 0)
+	measured := time.Unix(1599999000, 0)
+
+	req := cmd.NewOTLPRequest([]cmd.MetricData{
+		{
+			Name:       "m1",
+			MetricType: "histogram",
+			Stats: []cmd.MetricRecord{
+				{Value: 6, Labels: []string{"tenant"}, LabelValues: []string{"d01"}, Timestamp: measured, Histogram: &cmd.HistogramData{Buckets: map[float64]uint64{2.5: 4, 1: 1}, Count: 6, Sum: 3.5}},
+
+				// a plain record doesn't fit the histogram
+				{Value: 1, Labels: []string{"tenant"}, LabelValues: []string{"d02"}},
+			},
+		},
+		{
+			Name:       "m2",
+			MetricType: "summary",
+			Stats: []cmd.MetricRecord{
+				{Value: 3, Summary: &cmd.SummaryData{Quantiles: map[float64]float64{0.9: 8, 0.5: 2}, Count: 3, Sum: 12}},
+			},
+		},
+	}, now)
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(2, len(metrics))
+
+	// the cumulative buckets are split between the bounds, the record keeps
+	// its time
+	assert.Nil(metrics[0].Gauge)
+	assert.Equal(2, metrics[0].Histogram.AggregationTemporality)
+	assert.Equal([]cmd.OTLPHistogramDataPoint{{
+		Attributes:     []cmd.OTLPAttribute{{Key: "tenant", Value: cmd.OTLPAttributeValue{StringValue: "d01"}}},
+		TimeUnixNano:   uint64(measured.UnixNano()),
+		Count:          6,
+		Sum:            3.5,
+		BucketCounts:   []uint64{1, 3, 2},
+		ExplicitBounds: []float64{1, 2.5},
+	}}, metrics[0].Histogram.DataPoints)
+
+	// summary
+	assert.Nil(metrics[1].Gauge)
+	assert.Equal([]cmd.OTLPSummaryDataPoint{{
+		TimeUnixNano:   uint64(now.UnixNano()),
+		Count:          3,
+		Sum:            12,
+		QuantileValues: []cmd.OTLPQuantileValue{{Quantile: 0.5, Value: 2}, {Quantile: 0.9, Value: 8}},
+	}}, metrics[1].Summary.DataPoints)
+
+	// the json encoding of the otlp/http protocol
+	body, err := json.Marshal(metrics[0])
+	assert.NoError(err)
+	assert.Contains(string(body), `"histogram":{"dataPoints":[{"attributes"`)
+	assert.Contains(string(body), `"count":"6","sum":3.5,"bucketCounts":[1,3,2],"explicitBounds":[1,2.5]`)
+}
@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"context"
 	crypt "crypto/rand"
 	"fmt"
 	"io"
@@ -96,8 +97,12 @@ func (config *Config) SetPw(cmd *cobra.Command) error {
 	if err != nil {
 		return errors.Wrap(err, "prepare(getSecretMap)")
 	}
+	err = config.ExpandEndpoints()
+	if err != nil {
+		return errors.Wrap(err, "setPw(ExpandEndpoints)")
+	}
 	for i := range config.Tenants {
-		db := config.getConnection(i, secretMap)
+		db := config.getConnection(context.Background(), i, config.Tenants[i].ConnStr, secretMap)
 		if db == nil {
 			continue
 		}
@@ -15,11 +15,21 @@
 package cmd
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	goHdbDriver "github.com/SAP/go-hdb/driver"
@@ -33,33 +43,241 @@ import (
 
 // TenantInfo - tennant data
 type TenantInfo struct {
+	Name             string
+	Alias            string
+	Tags             []string
+	Group            string
+	MetricPrefix     string
+	ConnStr          string
+	Endpoints        []string
+	SystemConnStr    string
+	User             string
+	TLS              TLSInfo
+	DecimalSeparator string
+	MaxOpenConns     int
+	MaxIdleConns     int
+	ConnMaxLifetime  uint
+	Usage            string
+	Schemas          []string
+	MetricSQL        map[string]string
+	conn             *sql.DB
+	sysConn          *sql.DB
+	pools            map[string]*sql.DB
+	state            tenantState
+
+	// name of the tenant template, whose password is shared by its endpoints
+	template string
+
+	// hash of the password of the current connection
+	pwHash [sha256.Size]byte
+
+	// connected host per connection string with a host list
+	activeHosts map[string]string
+}
+
+// connection state of a tenant
+type tenantState int
+
+const (
+	tenantConnected tenantState = iota
+	tenantReconnecting
+	tenantDown
+)
+
+// PoolInfo - dedicated connection pool per tenant for the metrics referencing it
+type PoolInfo struct {
+	Name         string
+	MaxOpenConns int
+	MaxIdleConns int
+}
+
+// GroupInfo - scrape endpoint for the tenants of a group
+type GroupInfo struct {
 	Name    string
-	Tags    []string
-	ConnStr string
-	User    string
-	Usage   string
-	Schemas []string
-	conn    *sql.DB
+	Timeout uint
+}
+
+// TLSInfo - tls settings of the hana connection
+type TLSInfo struct {
+	ServerName         string
+	RootCAFile         string
+	InsecureSkipVerify *bool
+	MinVersion         string
+	CipherSuites       []string
 }
 
 // MetricInfo - metric data
 type MetricInfo struct {
-	Name         string
-	Help         string
-	MetricType   string
-	TagFilter    []string
-	SchemaFilter []string
-	SQL          string
+	Name            string
+	Help            string
+	MetricType      string
+	TagFilter       []string
+	SchemaFilter    []string
+	SQL             string
+	GateSQL         string
+	MemoryLimit     string
+	Timeout         float64
+	ValueColumn     string
+	ValueColumns    []string
+	AutoValueColumn bool
+	ValueFormat     string
+	ValueMode       string
+	DescColumn      string
+	SampleLimit     uint
+	Connection      string
+	MaxRows         uint
+	FilteredValue   *float64
+	LabelBuckets    map[string]float64
+	DuplicateLabels string
+	Pool            string
+	Global          bool
+	GlobalTenant    string
+	Params          []string
+	CounterFraction string
+	NullAsZero      bool
+	NullMode        string
+	MaskTenant      bool
+	InvalidValues   string
+	NegativeValues  string
+	ValueLimit      float64
+	MaxValue        *float64
+	MaxColumn       string
+	TimeColumn      string
+	MaxAge          float64
+	StripPrefixes   []string
+	WordSeparator   *string
+	PreserveCase    *bool
+	LabelColumns    []string
+	DropColumns     []string
+
+	// labels added by the exporter, which the columns must not use
+	reserved []string
 }
 
 // Config struct with config file infos
 type Config struct {
-	Secret   []byte
-	Tenants  []TenantInfo
-	Metrics  []MetricInfo
-	DataFunc func(mPos, tPos int) []MetricRecord
-	Timeout  uint
-	port     string
+	Secret            []byte
+	Tenants           []TenantInfo
+	Metrics           []MetricInfo
+	Groups            []GroupInfo
+	Pools             []PoolInfo
+	TLS               TLSInfo
+	DecimalSeparator  string
+	StripPrefixes     []string
+	WordSeparator     *string
+	PreserveCase      *bool
+	AllowedSchemas    []string
+	AllowedProcedures []string
+	Driver            string
+	DataFunc          func(ctx context.Context, mPos, tPos int) []MetricRecord
+	ConnectFunc       func(ctx context.Context, tPos int) error
+	Timeout           uint
+	TimeoutBuffer     float64
+	MinInterval       uint
+	SourceLabel       bool
+	InstanceLabel     bool
+	Instance          string
+	TagsLabel         bool
+	TenantPrefix      bool
+	QueryComment      bool
+	DefaultUsage      string
+	MaxScrapeDuration float64
+	WatchdogTimeout   float64
+	TenantConcurrency uint
+	QueryConcurrency  uint
+	RecheckInterval   uint
+	FailStatus        int
+	Oneshot           bool
+	LogInterval       uint
+	LogFilter         []string
+	LogOnly           bool
+	LogFormat         string
+	TableSizes        uint
+	InitTimeout       float64
+	ConnectRetries    uint
+	RetryInterval     float64
+	RetryMaxWait      float64
+	ErrorBuffer       uint
+	DebugToken        string
+	MaskKey           string
+	SecretInterval    uint
+	OTLPEndpoint      string
+	OTLPInterval      uint
+	GraphiteEndpoint  string
+	GraphiteInterval  uint
+	GraphiteTemplate  string
+	WebCertFile       string
+	WebKeyFile        string
+	ShutdownGrace     uint
+	ReconnectInterval uint
+	port              string
+	hash              string
+
+	// result of the last collection for the minimum scrape interval guard
+	guard       sync.Mutex
+	collected   time.Time
+	lastMetrics []MetricData
+
+	// recent collection errors for the diagnostics endpoint, the time of
+	// the last error per metric and tenant, the error counts per reason and
+	// the start of the last complete collection
+	errMu        sync.Mutex
+	recentErrors []CollectError
+	lastErrors   map[[2]string]time.Time
+	errorCounts  map[[3]string]float64
+	collectStart time.Time
+
+	// duration of the last query per metric and tenant
+	durMu     sync.Mutex
+	durations map[[2]string]float64
+
+	// number of running collection goroutines
+	goroutines int32
+
+	// metric goroutines of the collections, which outlive a partial or
+	// cancelled collection
+	metricRuns sync.WaitGroup
+
+	// collection cancelled by the watchdog, which hasn't returned yet
+	stallMu sync.Mutex
+	stalled bool
+
+	// slots of the queries running at the same time across all metrics
+	slotsOnce  sync.Once
+	querySlots chan struct{}
+
+	// time to write the metrics responses before the write timeout
+	writeBudget time.Duration
+
+	// scrape timeout of the request header for the cached collection
+	timeoutMu  sync.Mutex
+	reqTimeout time.Duration
+
+	// time of the last reconnect per tenant
+	reconnMu   sync.Mutex
+	reconnects map[string]*reconnect
+
+	// reconnects running in the background
+	revives sync.WaitGroup
+
+	// metrics per tenant, whose objects don't exist
+	unavailMu   sync.Mutex
+	unavailable map[[2]string]time.Time
+
+	// scrape-time parameters of the running collection
+	paramMu sync.Mutex
+	params  map[string]string
+	// tenants, their connections, states, usage and schemas, which are also
+	// read and written outside of the collections, e.g. by the readiness
+	// probe, the exporter metrics and the reconnects of an abandoned
+	// collection
+	connMu sync.RWMutex
+
+	// readiness after the first complete collection
+	readyMu sync.Mutex
+	ready   bool
+	warming bool
+	warmed  time.Time
 }
 
 var cfgFile string
@@ -91,26 +309,96 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
+	if cfgFile == "" {
 		// Find home directory.
 		home, err := homedir.Dir()
 		if err != nil {
 			exit("Homedir can't be found: ", err)
 		}
 
-		// Search config in home directory with name ".hana_sql_exporter" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigType("toml")
-		viper.SetConfigName(".hana_sql_exporter.toml")
+		// Search config in home directory with name ".hana_sql_exporter" and
+		// extension toml, yaml or yml.
+		cfgFile = ConfigFile(home)
+	}
+
+	// toml and yaml are unmarshaled into the same structs, so both formats
+	// give the same config. The password command writes the secret back in
+	// the format of the file.
+	cfgType, err := ConfigType(cfgFile)
+	if err != nil {
+		exit("Problem with config file: ", err)
 	}
+	viper.SetConfigFile(cfgFile)
+	viper.SetConfigType(cfgType)
 
 	// viper.AutomaticEnv() // read in environment variables that match
 
 }
 
+// timestamp format of the text log
+const logTimestampFormat = "02-01-2006 15:04:05"
+
+// SetLogFormat - switch the log to text (default) or json, e.g. for log
+// pipelines, which index the fields of the log entries
+func SetLogFormat(format string) error {
+	switch low(format) {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: logTimestampFormat,
+		})
+	case "json":
+		// rfc3339 timestamps, which log pipelines parse without configuration
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.Errorf("SetLogFormat(unknown log format %s - text or json expected)", format)
+	}
+	return nil
+}
+
+// SetLogLevel - minimum level of the logged entries: debug, info (default),
+// warn or error
+func SetLogLevel(level string) error {
+	switch low(level) {
+	case "":
+		log.SetLevel(log.InfoLevel)
+	case "debug", "info", "warn", "warning", "error":
+		lvl, err := log.ParseLevel(low(level))
+		if err != nil {
+			return errors.Wrap(err, "SetLogLevel(ParseLevel)")
+		}
+		log.SetLevel(lvl)
+	default:
+		return errors.Errorf("SetLogLevel(unknown log level %s - debug, info, warn or error expected)", level)
+	}
+	return nil
+}
+
+// ConfigType - format of the config file by its extension
+func ConfigType(file string) (string, error) {
+	switch low(filepath.Ext(file)) {
+	case ".toml":
+		return "toml", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	return "", errors.Errorf("ConfigType(unknown format of %s - toml, yaml or yml expected)", file)
+}
+
+// ConfigFile - default config file in the directory. The first existing file
+// of .hana_sql_exporter.toml, .hana_sql_exporter.yaml and
+// .hana_sql_exporter.yml, otherwise the toml file.
+func ConfigFile(dir string) string {
+	for _, ext := range []string{".toml", ".yaml", ".yml"} {
+		file := filepath.Join(dir, ".hana_sql_exporter"+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return filepath.Join(dir, ".hana_sql_exporter.toml")
+}
+
 // read and unmarshal configfile into Config struct
 func getConfig() (*Config, error) {
 	var config Config
@@ -124,50 +412,615 @@ func getConfig() (*Config, error) {
 		return nil, errors.Wrap(err, "getConfig(Unmarshal)")
 	}
 
+	if err := config.ExpandEnv(os.LookupEnv); err != nil {
+		return nil, errors.Wrap(err, "getConfig(ExpandEnv)")
+	}
+
 	return &config, nil
 }
 
+// ExpandEnv - replace ${VAR} and $VAR in name, connection string and user of
+// the tenants by the environment variables, so that they need not be stored
+// in the config file. Undefined variables are an error.
+func (config *Config) ExpandEnv(lookup func(string) (string, bool)) error {
+	for i := range config.Tenants {
+		tenant := config.Tenants[i].Name
+		for _, field := range []*string{&config.Tenants[i].Name, &config.Tenants[i].ConnStr, &config.Tenants[i].User} {
+			var missing []string
+			*field = os.Expand(*field, func(name string) string {
+				value, ok := lookup(name)
+				if !ok {
+					missing = append(missing, name)
+				}
+				return value
+			})
+			if len(missing) > 0 {
+				return errors.Errorf("ExpandEnv(tenant %s: undefined environment variable %s)", tenant, strings.Join(missing, ", "))
+			}
+		}
+	}
+	return nil
+}
+
 // exit program with error message
 func exit(msg string, err error) {
 	fmt.Println(msg, err)
 	os.Exit(1)
 }
 
-// prepare, establish, check and return connection to hana db
-func (config *Config) getConnection(tId int, secretMap internal.Secret) *sql.DB {
+// ConnectTenant - (re)connect to the tenant and get the remaining tenant infos.
+// The connect is cancelled with the context.
+func (config *Config) ConnectTenant(ctx context.Context, tPos int) error {
 
-	pw, err := GetPassword(secretMap, config.Tenants[tId].Name)
+	secretMap, err := config.GetSecretMap()
+	if err != nil {
+		return errors.Wrap(err, "ConnectTenant(GetSecretMap)")
+	}
+
+	db := config.getConnection(ctx, tPos, config.Tenants[tPos].ConnStr, secretMap)
+	if db == nil {
+		return errors.New("ConnectTenant(getConnection)")
+	}
+	config.connMu.Lock()
+	old := config.Tenants[tPos].conn
+	config.Tenants[tPos].conn = db
+	config.connMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	// optional connection to the system db of the tenant
+	if "" != config.Tenants[tPos].SystemConnStr {
+		sysDb := config.getConnection(ctx, tPos, config.Tenants[tPos].SystemConnStr, secretMap)
+		if sysDb == nil {
+			return errors.New("ConnectTenant(getConnection system db)")
+		}
+		config.connMu.Lock()
+		old := config.Tenants[tPos].sysConn
+		config.Tenants[tPos].sysConn = sysDb
+		config.connMu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+	}
+
+	// dedicated pools, so that heavy metrics don't starve the others
+	config.connMu.Lock()
+	config.Tenants[tPos].closePools()
+	config.connMu.Unlock()
+	for _, pool := range config.Pools {
+		poolDb := config.getConnection(ctx, tPos, config.Tenants[tPos].ConnStr, secretMap)
+		if poolDb == nil {
+			return errors.New("ConnectTenant(getConnection pool " + pool.Name + ")")
+		}
+		if pool.MaxOpenConns > 0 {
+			poolDb.SetMaxOpenConns(pool.MaxOpenConns)
+		}
+		if pool.MaxIdleConns > 0 {
+			poolDb.SetMaxIdleConns(pool.MaxIdleConns)
+		}
+		config.connMu.Lock()
+		config.Tenants[tPos].SetPool(pool.Name, poolDb)
+		config.connMu.Unlock()
+	}
+
+	// get tenant usage and hana-user schema information
+	err = config.CollectRemainingTenantInfos(ctx, tPos)
+	if err != nil {
+		return errors.Wrap(err, "ConnectTenant(CollectRemainingTenantInfos)")
+	}
+	return nil
+}
+
+// prepare, establish, check and return connection to hana db. A connection
+// string with a comma separated host list, e.g. the primary and secondary of
+// a system replication, gets the first host, which can be pinged. The host of
+// the last connection is tried first.
+func (config *Config) getConnection(parent context.Context, tId int, connStr string, secretMap internal.Secret) *sql.DB {
+
+	pw, err := GetPassword(secretMap, config.Tenants[tId].secretName())
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tenant": config.Tenants[tId].Name,
 		}).Error("Cannot find password for tenant.")
 		return nil
 	}
-	db := config.dbConnect(tId, pw)
-	if db == nil {
+
+	config.connMu.RLock()
+	hosts := config.Tenants[tId].hostOrder(connStr)
+	config.connMu.RUnlock()
+	for _, host := range hosts {
+		db := config.dbConnect(tId, host, pw)
+		if db == nil {
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[tId].Name,
+				"host":   host,
+			}).Error("Can't get connection.")
+			continue
+		}
+
+		ctx, cancel := config.InitContext(parent)
+		err := db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			db.Close()
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[tId].Name,
+				"host":   host,
+			}).Error("Cannot ping tenant. Perhaps wrong password?")
+			continue
+		}
+		config.connMu.Lock()
+		config.Tenants[tId].setActiveHost(connStr, host)
+		config.connMu.Unlock()
+		config.Tenants[tId].pwHash = sha256.Sum256([]byte(pw))
+		return db
+	}
+	return nil
+}
+
+// Hosts - hosts of a connection string with a comma separated host list
+func Hosts(connStr string) []string {
+	var hosts []string
+	for _, host := range strings.Split(connStr, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hosts of the connection string, the active host first
+func (t *TenantInfo) hostOrder(connStr string) []string {
+	hosts := Hosts(connStr)
+	active, ok := t.activeHosts[connStr]
+	if !ok {
+		return hosts
+	}
+	order := []string{active}
+	for _, host := range hosts {
+		if host != active {
+			order = append(order, host)
+		}
+	}
+	return order
+}
+
+// remember the connected host of a connection string with a host list
+func (t *TenantInfo) setActiveHost(connStr, host string) {
+	if len(Hosts(connStr)) < 2 {
+		return
+	}
+	if t.activeHosts == nil {
+		t.activeHosts = make(map[string]string)
+	}
+	t.activeHosts[connStr] = host
+}
+
+// ActiveHost - connected host of the tenant db, before the first connection
+// the first host of the connection string
+func (t *TenantInfo) ActiveHost() string {
+	if host, ok := t.activeHosts[t.ConnStr]; ok {
+		return host
+	}
+	if hosts := Hosts(t.ConnStr); len(hosts) > 0 {
+		return hosts[0]
+	}
+	return t.ConnStr
+}
+
+// RefreshSecret - replace the secret and reconnect the tenants, whose
+// password changed, e.g. after a credential rotation
+func (config *Config) RefreshSecret(secret []byte) error {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	config.Secret = secret
+	secretMap, err := config.GetSecretMap()
+	if err != nil {
+		return errors.Wrap(err, "RefreshSecret(GetSecretMap)")
+	}
+
+	for tPos := range config.Tenants {
+		tenant := &config.Tenants[tPos]
+
+		pw, err := GetPassword(secretMap, tenant.secretName())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"tenant": tenant.Name,
+				"error":  err,
+			}).Warn("Can't decrypt refreshed password of tenant - connection kept.")
+			continue
+		}
+		if sha256.Sum256([]byte(pw)) == tenant.pwHash {
+			continue
+		}
+
 		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error("Can't get connection.")
-		return nil
+			"tenant": tenant.Name,
+		}).Info("Password of tenant changed - reconnecting.")
+		config.setState(tPos, tenantReconnecting)
+		if err := config.ConnectFunc(context.Background(), tPos); err != nil {
+			config.setState(tPos, tenantDown)
+			continue
+		}
+		config.setState(tPos, tenantConnected)
+	}
+	return nil
+}
+
+// SecretRefresher - read the secret of the configfile at every tick and
+// refresh the tenant connections
+func (config *Config) SecretRefresher(tick <-chan time.Time, read func() ([]byte, error)) {
+	for range tick {
+		secret, err := read()
+		if err == nil {
+			err = config.RefreshSecret(secret)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Can't refresh secret.")
+		}
 	}
-	// defer db.Close()
+}
+
+// Reload - replace tenants and metrics by the ones of the changed config file
+// and connect the tenants again. The collections are blocked meanwhile, so
+// that they never see a half updated config. If the new config is invalid,
+// the old one is kept.
+func (config *Config) Reload(next *Config) error {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	// queries of timed out tenants may still use the old tenants
+	config.waitCollections()
 
-	if err := db.Ping(); err != nil {
+	secret, tenants, metrics, pools := config.Secret, config.Tenants, config.Metrics, config.Pools
+	tls, separator, prefixes, schemas := config.TLS, config.DecimalSeparator, config.StripPrefixes, config.AllowedSchemas
+	procedures, words, cases := config.AllowedProcedures, config.WordSeparator, config.PreserveCase
+	restore := func() {
+		config.Secret, config.Metrics, config.Pools = secret, metrics, pools
+		config.setTenants(tenants)
+		config.TLS, config.DecimalSeparator, config.StripPrefixes, config.AllowedSchemas = tls, separator, prefixes, schemas
+		config.AllowedProcedures, config.WordSeparator, config.PreserveCase = procedures, words, cases
+	}
+
+	config.Secret, config.Metrics, config.Pools = next.Secret, next.Metrics, next.Pools
+	config.setTenants(next.Tenants)
+	config.TLS, config.DecimalSeparator, config.StripPrefixes, config.AllowedSchemas = next.TLS, next.DecimalSeparator, next.StripPrefixes, next.AllowedSchemas
+	config.AllowedProcedures, config.WordSeparator, config.PreserveCase = next.AllowedProcedures, next.WordSeparator, next.PreserveCase
+
+	if err := config.ValidateMetrics(); err != nil {
+		restore()
+		return errors.Wrap(err, "Reload(ValidateMetrics)")
+	}
+	hash, err := config.ConfigHash()
+	if err != nil {
+		restore()
+		return errors.Wrap(err, "Reload(ConfigHash)")
+	}
+	if config.TableSizes > 0 {
+		config.Metrics = append(config.Metrics, TableSizeMetrics(config.TableSizes)...)
+	}
+	prepared, err := config.Prepare()
+	if err != nil {
+		restore()
+		return errors.Wrap(err, "Reload(Prepare)")
+	}
+	config.setTenants(prepared)
+	config.hash = hash
+	closeConnections(tenants)
+
+	// results and unavailable objects of the old config are outdated
+	config.lastMetrics = nil
+	config.collected = time.Time{}
+	config.unavailMu.Lock()
+	config.unavailable = nil
+	config.unavailMu.Unlock()
+	config.pruneStats()
+	return nil
+}
+
+// ConfigReloader - read the config file at every signal and reload tenants
+// and metrics
+func (config *Config) ConfigReloader(sig <-chan os.Signal, read func() (*Config, error)) {
+	for range sig {
+		next, err := read()
+		if err == nil {
+			err = config.Reload(next)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Can't reload config - old config kept.")
+			continue
+		}
 		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error("Cannot ping tenant. Perhaps wrong password?")
+			"tenants": len(config.Tenants),
+			"metrics": len(config.Metrics),
+		}).Info("Config reloaded.")
+	}
+}
+
+// wait until the collection goroutines and a collection cancelled by the
+// watchdog have returned, so that none of them uses the replaced tenants and
+// metrics. They are cancelled, so the wait ends at the latest with the
+// timeouts of their queries.
+func (config *Config) waitCollections() {
+	warn := time.Now().Add(time.Duration(config.Timeout) * time.Second)
+	for atomic.LoadInt32(&config.goroutines) > 0 || config.Stalled() {
+		if !warn.IsZero() && time.Now().After(warn) {
+			log.WithFields(log.Fields{
+				"goroutines": atomic.LoadInt32(&config.goroutines),
+			}).Warn("Reload waits for running collections.")
+			warn = time.Time{}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	config.metricRuns.Wait()
+	config.WaitReconnects()
+}
+
+// drop the durations, errors and reconnects of metrics and tenants, which are
+// no longer configured, so that their series aren't exported anymore
+func (config *Config) pruneStats() {
+	metrics := make(map[string]bool)
+	for _, metric := range config.Metrics {
+		metrics[metric.Name] = true
+	}
+
+	// errors of a metric without tenant, e.g. timeouts, have an empty tenant
+	tenants := map[string]bool{"": true}
+	for _, tenant := range config.Tenants {
+		tenants[low(tenant.Name)] = true
+	}
+
+	config.errMu.Lock()
+	for key := range config.lastErrors {
+		if !metrics[key[0]] || !tenants[key[1]] {
+			delete(config.lastErrors, key)
+		}
+	}
+	for key := range config.errorCounts {
+		if !metrics[key[0]] || !tenants[key[1]] {
+			delete(config.errorCounts, key)
+		}
+	}
+	config.errMu.Unlock()
+
+	config.durMu.Lock()
+	for key := range config.durations {
+		if !metrics[key[0]] || !tenants[key[1]] {
+			delete(config.durations, key)
+		}
+	}
+	config.durMu.Unlock()
+
+	config.reconnMu.Lock()
+	for name := range config.reconnects {
+		if !tenants[name] {
+			delete(config.reconnects, name)
+		}
+	}
+	config.reconnMu.Unlock()
+}
+
+// CloseConnections - close the connections of all tenants, after running
+// collections are finished
+func (config *Config) CloseConnections() {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	closeConnections(config.Tenants)
+}
+
+// close the connections of the tenants
+func closeConnections(tenants []TenantInfo) {
+	for i := range tenants {
+		if tenants[i].conn != nil {
+			tenants[i].conn.Close()
+		}
+		if tenants[i].sysConn != nil {
+			tenants[i].sysConn.Close()
+		}
+		tenants[i].closePools()
+	}
+}
+
+// last reconnect of a tenant
+type reconnect struct {
+	sync.Mutex
+	last time.Time
+
+	// reconnect in the background, guarded by reconnMu
+	running bool
+}
+
+// reconnect information of the tenant
+func (config *Config) reconnectOf(tPos int) *reconnect {
+	name := low(config.Tenants[tPos].Name)
+
+	config.reconnMu.Lock()
+	defer config.reconnMu.Unlock()
+
+	if config.reconnects == nil {
+		config.reconnects = make(map[string]*reconnect)
+	}
+	r, ok := config.reconnects[name]
+	if !ok {
+		r = &reconnect{}
+		config.reconnects[name] = r
+	}
+	return r
+}
+
+// ReconnectTenant - connect the tenant again, the password is decrypted anew.
+// The reconnects of a tenant are limited to one per reconnect interval, so
+// that a down tenant doesn't spin. True, if the tenant is connected by this or
+// a recent reconnect.
+func (config *Config) ReconnectTenant(ctx context.Context, tPos int) bool {
+	if config.ConnectFunc == nil {
+		return false
+	}
+
+	r := config.reconnectOf(tPos)
+	r.Lock()
+	defer r.Unlock()
+
+	return config.reconnect(ctx, tPos, r)
+}
+
+// ReopenConnection - reconnect the tenant, whose connection db of the metric
+// dropped during a query, and return the new connection for a single retry or
+// nil. The reopens of a tenant are serialized, so that the metric goroutines,
+// which share the dropped connection, reconnect it only once and retry on the
+// connection reopened by the first one.
+func (config *Config) ReopenConnection(ctx context.Context, mPos, tPos int, db *sql.DB) *sql.DB {
+	if config.ConnectFunc == nil {
 		return nil
 	}
-	return db
+
+	r := config.reconnectOf(tPos)
+	r.Lock()
+	defer r.Unlock()
+
+	metric := &config.Metrics[mPos]
+	if current := config.connection(tPos, metric); current != db {
+		return current
+	}
+	if !config.reconnect(ctx, tPos, r) {
+		return nil
+	}
+	if current := config.connection(tPos, metric); current != db {
+		return current
+	}
+	return nil
+}
+
+// reconnect the tenant, if the last reconnect is older than the reconnect
+// interval - the lock of r must be held by the caller
+func (config *Config) reconnect(ctx context.Context, tPos int, r *reconnect) bool {
+	if time.Since(r.last) < time.Duration(config.ReconnectInterval)*time.Second {
+		return config.stateOf(tPos) == tenantConnected
+	}
+	r.last = time.Now()
+
+	config.setState(tPos, tenantReconnecting)
+	if err := config.ConnectFunc(ctx, tPos); err != nil {
+		log.WithFields(log.Fields{
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Warn("Can't reconnect tenant.")
+		config.setState(tPos, tenantDown)
+		return false
+	}
+	config.setState(tPos, tenantConnected)
+	return true
+}
+
+// reconnect the tenant in the background, unless a reconnect of it is running
+// already. The tenant is marked as reconnecting, so that the collections skip
+// it meanwhile.
+func (config *Config) reviveTenant(tPos int) {
+	r := config.reconnectOf(tPos)
+
+	config.reconnMu.Lock()
+	if r.running {
+		config.reconnMu.Unlock()
+		return
+	}
+	r.running = true
+	config.reconnMu.Unlock()
+
+	config.setState(tPos, tenantReconnecting)
+	config.revives.Add(1)
+	go func() {
+		defer config.revives.Done()
+
+		// the connect and the discovery queries are limited by the init timeout
+		if !config.ReconnectTenant(context.Background(), tPos) {
+			config.setState(tPos, tenantDown)
+		}
+		config.reconnMu.Lock()
+		r.running = false
+		config.reconnMu.Unlock()
+	}()
+}
+
+// WaitReconnects - wait until the reconnects running in the background have
+// finished
+func (config *Config) WaitReconnects() {
+	config.revives.Wait()
+}
+
+// read the secret of the configfile again
+func readSecret() ([]byte, error) {
+	config, err := getConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "readSecret(getConfig)")
+	}
+	return config.Secret, nil
 }
 
 // connect to hana db
-func (config *Config) dbConnect(tId int, pw string) *sql.DB {
+func (config *Config) dbConnect(tId int, connStr, pw string) *sql.DB {
+
+	driverName := config.Driver
+	if "" == driverName {
+		driverName = goHdbDriver.DriverName
+	}
 
-	dsn := fmt.Sprintf("hdb://%s:%s@%s",
+	dsn := fmt.Sprintf("%s://%s:%s@%s",
+		driverName,
 		config.Tenants[tId].User,
 		url.QueryEscape(pw),
-		config.Tenants[tId].ConnStr)
+		connStr)
+
+	var db *sql.DB
+	if goHdbDriver.DriverName == driverName {
+		db = config.hdbOpen(tId, dsn)
+		if db == nil {
+			return nil
+		}
+	} else {
+
+		// other registered drivers get the plain dsn, e.g. mock drivers for testing
+		var err error
+		db, err = sql.Open(driverName, dsn)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[tId].Name,
+				"driver": driverName,
+				"error":  err,
+			}).Error("Can't open database with driver.")
+			return nil
+		}
+	}
+	config.Tenants[tId].setPoolLimits(db)
+
+	return db
+}
+
+// apply the connection pool limits of the tenant, unset limits get the defaults
+func (t *TenantInfo) setPoolLimits(db *sql.DB) {
+	maxOpen, maxIdle, lifetime := 25, 25, 5*time.Minute
+	if t.MaxOpenConns > 0 {
+		maxOpen = t.MaxOpenConns
+	}
+	if t.MaxIdleConns > 0 {
+		maxIdle = t.MaxIdleConns
+	}
+	if t.ConnMaxLifetime > 0 {
+		lifetime = time.Duration(t.ConnMaxLifetime) * time.Second
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(lifetime)
+}
+
+// open hana db with the go-hdb connector, which supports timeout and tls settings
+func (config *Config) hdbOpen(tId int, dsn string) *sql.DB {
 
 	connector, err := goHdbDriver.NewDSNConnector(dsn)
 
@@ -176,12 +1029,306 @@ func (config *Config) dbConnect(tId int, pw string) *sql.DB {
 	}
 	connector.SetTimeout(time.Duration(config.Timeout) * time.Second)
 
-	db := sql.OpenDB(connector)
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	if config.Tenants[tId].TLS.used() {
+		tlsConfig, err := config.Tenants[tId].TLS.TLSConfig()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[tId].Name,
+				"error":  err,
+			}).Error("Can't build tls config.")
+			return nil
+		}
+		if err := connector.SetTLSConfig(tlsConfig); err != nil {
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[tId].Name,
+				"error":  err,
+			}).Error("Can't set tls config.")
+			return nil
+		}
+	}
 
-	return db
+	return sql.OpenDB(connector)
+}
+
+// SetConnections - set the tenant and system db connection of a tenant
+func (config *Config) SetConnections(tPos int, conn, sysConn *sql.DB) {
+	config.connMu.Lock()
+	defer config.connMu.Unlock()
+
+	config.Tenants[tPos].conn = conn
+	config.Tenants[tPos].sysConn = sysConn
+}
+
+// connection of the tenant, the metric is targeted at
+func (config *Config) connection(tPos int, metric *MetricInfo) *sql.DB {
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+
+	return config.Tenants[tPos].Connection(metric)
+}
+
+// copy of the tenant, whose usage and schemas are replaced by reconnects
+func (config *Config) tenantOf(tPos int) TenantInfo {
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+
+	return config.Tenants[tPos]
+}
+
+// schemas of the tenant
+func (config *Config) schemasOf(tPos int) []string {
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+
+	return config.Tenants[tPos].Schemas
+}
+
+// connection state of the tenant
+func (config *Config) stateOf(tPos int) tenantState {
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+
+	return config.Tenants[tPos].state
+}
+
+// set the connection state of the tenant
+func (config *Config) setState(tPos int, state tenantState) {
+	config.connMu.Lock()
+	config.Tenants[tPos].state = state
+	config.connMu.Unlock()
+}
+
+// SetPool - set the dedicated connection pool of a tenant
+func (t *TenantInfo) SetPool(name string, db *sql.DB) {
+	if t.pools == nil {
+		t.pools = make(map[string]*sql.DB)
+	}
+	t.pools[low(name)] = db
+}
+
+// close all dedicated connection pools of a tenant
+func (t *TenantInfo) closePools() {
+	for name, db := range t.pools {
+		db.Close()
+		delete(t.pools, name)
+	}
+}
+
+// Connection - connection of the tenant, the metric is targeted at. Nil, if
+// the metric targets the system db and the tenant has none.
+func (t *TenantInfo) Connection(metric *MetricInfo) *sql.DB {
+	if "system" == low(metric.Connection) {
+		return t.sysConn
+	}
+	if "" != metric.Pool {
+		return t.pools[low(metric.Pool)]
+	}
+	return t.conn
+}
+
+// ExpandEndpoints - replace every tenant with endpoints by one tenant per
+// endpoint. The tenants get the port of their endpoint as name suffix and share
+// the password and all other settings of the template.
+func (config *Config) ExpandEndpoints() error {
+
+	var tenants []TenantInfo
+	names := make(map[string]bool)
+	for _, tenant := range config.Tenants {
+
+		expanded := []TenantInfo{tenant}
+		if len(tenant.Endpoints) > 0 {
+			expanded = nil
+			for _, endpoint := range tenant.Endpoints {
+				_, port, err := net.SplitHostPort(endpoint)
+				if err != nil {
+					return errors.Wrap(err, "ExpandEndpoints(SplitHostPort)")
+				}
+				if _, err = strconv.Atoi(port); err != nil {
+					return errors.Errorf("ExpandEndpoints(invalid port of endpoint %s)", endpoint)
+				}
+
+				t := tenant
+				t.Name = tenant.Name + "_" + port
+				t.ConnStr = endpoint
+				t.Endpoints = nil
+				t.Tags = append([]string(nil), tenant.Tags...)
+				t.Schemas = append([]string(nil), tenant.Schemas...)
+				t.template = tenant.Name
+				expanded = append(expanded, t)
+			}
+		}
+
+		for _, t := range expanded {
+			if names[low(t.Name)] {
+				return errors.Errorf("ExpandEndpoints(duplicate tenant %s)", t.Name)
+			}
+			names[low(t.Name)] = true
+		}
+		tenants = append(tenants, expanded...)
+	}
+	config.setTenants(tenants)
+	return nil
+}
+
+// replace the tenants, which the readiness probe reads outside of the
+// collections
+func (config *Config) setTenants(tenants []TenantInfo) {
+	config.connMu.Lock()
+	config.Tenants = tenants
+	config.connMu.Unlock()
+}
+
+// name of the tenant in the secret map
+func (t *TenantInfo) secretName() string {
+	if "" != t.template {
+		return t.template
+	}
+	return t.Name
+}
+
+// InheritTLS - tenants inherit the global tls settings they don't specify
+// themselves. The global restrictions of the tls version and the cipher suites
+// apply to the web server as well, so they are only inherited by tenants,
+// which use tls anyway, instead of switching it on for all of them.
+func (config *Config) InheritTLS() {
+	for i := range config.Tenants {
+		tenantTLS := &config.Tenants[i].TLS
+
+		if "" == tenantTLS.ServerName {
+			tenantTLS.ServerName = config.TLS.ServerName
+		}
+		if "" == tenantTLS.RootCAFile {
+			tenantTLS.RootCAFile = config.TLS.RootCAFile
+		}
+		if nil == tenantTLS.InsecureSkipVerify {
+			tenantTLS.InsecureSkipVerify = config.TLS.InsecureSkipVerify
+		}
+		if !tenantTLS.used() {
+			continue
+		}
+		if "" == tenantTLS.MinVersion {
+			tenantTLS.MinVersion = config.TLS.MinVersion
+		}
+		if nil == tenantTLS.CipherSuites {
+			tenantTLS.CipherSuites = config.TLS.CipherSuites
+		}
+	}
+}
+
+// ValidateTLS - check the tls settings of all tenants and of the web server,
+// so that e.g. an unreadable root ca file or an unknown cipher suite stops the
+// exporter instead of failing every connect
+func (config *Config) ValidateTLS() error {
+	for _, t := range config.Tenants {
+		if !t.TLS.used() {
+			continue
+		}
+		_, err := t.TLS.TLSConfig()
+		if err != nil {
+			return errors.Wrapf(err, "ValidateTLS(tenant %s)", t.Name)
+		}
+	}
+	_, err := config.ServerTLSConfig()
+	if err != nil {
+		return errors.Wrap(err, "ValidateTLS(web server)")
+	}
+	return nil
+}
+
+// ServerTLSConfig - tls config of the web server with the minimum version and
+// the cipher suites of the global tls settings
+func (config *Config) ServerTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	err := config.TLS.restrict(tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "ServerTLSConfig(restrict)")
+	}
+	return tlsConfig, nil
+}
+
+// InheritDecimalSeparator - tenants without own decimal separator use the
+// global one, only "." and "," are supported
+func (config *Config) InheritDecimalSeparator() error {
+	for i := range config.Tenants {
+		if "" == config.Tenants[i].DecimalSeparator {
+			config.Tenants[i].DecimalSeparator = config.DecimalSeparator
+		}
+		switch config.Tenants[i].DecimalSeparator {
+		case "", ".", ",":
+		default:
+			return errors.Errorf("InheritDecimalSeparator(unsupported separator %q of tenant %s)", config.Tenants[i].DecimalSeparator, config.Tenants[i].Name)
+		}
+	}
+	return nil
+}
+
+// true, if the connection should be encrypted
+func (t *TLSInfo) used() bool {
+	return "" != t.ServerName || "" != t.RootCAFile || nil != t.InsecureSkipVerify ||
+		"" != t.MinVersion || len(t.CipherSuites) > 0
+}
+
+// TLSConfig - tls config of the hana connection
+func (t *TLSInfo) TLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		ServerName: t.ServerName,
+	}
+	if nil != t.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = *t.InsecureSkipVerify
+	}
+	err := t.restrict(tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "TLSConfig(restrict)")
+	}
+
+	if "" != t.RootCAFile {
+		pem, err := ioutil.ReadFile(t.RootCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "TLSConfig(ReadFile)")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("TLSConfig(no certificates found in root ca file)")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// supported minimum tls versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// set the minimum version and the cipher suites of the tls settings. Only
+// the secure cipher suites of go can be selected, the cipher suites of tls
+// 1.3 are not configurable.
+func (t *TLSInfo) restrict(tlsConfig *tls.Config) error {
+	if "" != t.MinVersion {
+		version, ok := tlsVersions[strings.TrimPrefix(low(t.MinVersion), "tls")]
+		if !ok {
+			return errors.Errorf("restrict(unknown tls version %s)", t.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range t.CipherSuites {
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, strings.TrimSpace(name)) {
+				id = suite.ID
+				break
+			}
+		}
+		if 0 == id {
+			return errors.Errorf("restrict(unknown or insecure cipher suite %s)", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return nil
 }
 
 func low(str string) string {
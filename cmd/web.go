@@ -15,36 +15,146 @@
 package cmd
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// maximum length of label values built by the exporter itself
+const maxLabelValueLength = 256
+
+// valid prometheus metric name
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// marker of a collection, which exceeded the maximum scrape duration
+const scrapePartialName = "hana_sql_exporter_scrape_partial"
+
+// marker of a response, which was cut off before the write timeout
+const scrapeTruncatedName = "hana_sql_exporter_scrape_truncated"
+
+// time reserved before the write timeout to finish the response
+const writeMargin = time.Second
+
+// marker of a collection, which was stopped by the watchdog
+const scrapeStalledName = "hana_sql_exporter_scrape_stalled"
+
+// valid name of a tenant group, which is part of the path of its endpoint
+var groupNameRE = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// valid name of a scrape-time parameter
+var paramNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// error of a value column, which is not numeric
+var errValueNotNumeric = errors.New("GetMetricRows(value column must be numeric)")
+
+// valid prometheus label name
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// maximum number of characters of the description label of info metrics
+const maxDescriptionLength = 128
+
+// layout of HANA timestamps converted to strings
+const hanaTimestampFormat = "2006-01-02 15:04:05.999999999"
+
+// maximum duration of the readiness probe
+const probeTimeout = 3 * time.Second
+
+// minimum interval between the background collections of the startup probe
+const warmUpInterval = 30 * time.Second
+
+// errors of the metrics handlers by cause, named like the ones of promhttp
+var handlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "promhttp_metric_handler_errors_total",
+	Help: "Total number of internal errors encountered by the promhttp metric handler.",
+}, []string{"cause"})
+
+// valid statement memory limit in GB
+var memoryLimitRE = regexp.MustCompile(`^[1-9][0-9]*$`)
+
+// call of a procedure with optional schema and arguments, but without further
+// statements
+var procedureCallRE = regexp.MustCompile(`(?is)^call\s+((?:"[^"]+"|[a-z_<>][a-z0-9_$#<>]*)(?:\.(?:"[^"]+"|[a-z_][a-z0-9_$#]*))?)\s*(?:\([^;]*\))?$`)
+
+// statements and clauses, which change data or the schema
+var modifyingRE = regexp.MustCompile(`(?i)\b(insert|update|upsert|delete|merge|create|alter|drop|truncate|rename|grant|revoke|call)\b`)
+
+// leading block or line comment of a statement
+var leadingCommentRE = regexp.MustCompile(`^(?s:/\*.*?\*/|--[^\n]*(?:\n|$))`)
+
 type collector struct {
 	// possible metric descriptions.
 	Desc *prometheus.Desc
 
 	// a parameterized function used to gather metrics.
 	stats func() []MetricData
+
+	// value of the instance label of all metrics, empty if disabled
+	instance string
+
+	// number of truncations because of the sample limit per metric
+	mu        sync.Mutex
+	limitHits map[string]float64
 }
 
 // MetricData - metric data
 type MetricData struct {
-	Name       string
-	Help       string
-	MetricType string
-	Stats      []MetricRecord
+	Name        string
+	Help        string
+	MetricType  string
+	SampleLimit uint
+	Stats       []MetricRecord
+}
+
+// MetricName - name of the metric of the record with the prefix of its tenant
+// and the suffix of its value column
+func (v MetricRecord) MetricName(name string) string {
+	if "" != v.Prefix {
+		name = v.Prefix + "_" + name
+	}
+	if "" != v.Suffix {
+		name = name + "_" + v.Suffix
+	}
+	return name
+}
+
+// SummaryData - quantiles, count and sum of a summary
+type SummaryData struct {
+	Quantiles map[float64]float64
+	Count     uint64
+	Sum       float64
 }
 
 // MetricRecord - metric stats record
@@ -52,6 +162,58 @@ type MetricRecord struct {
 	Value       float64
 	Labels      []string
 	LabelValues []string
+	Prefix      string
+	Suffix      string
+
+	// time of the measurement from the time column, zero means scrape time
+	Timestamp time.Time
+
+	// origin of the record for the help template
+	Tenant string
+	Schema string
+
+	// buckets of histogram metrics, the value is the count
+	Histogram *HistogramData
+
+	// quantiles of summary metrics, the value is the count
+	Summary *SummaryData
+}
+
+// HistogramData - cumulative bucket counts, count and sum of a histogram
+type HistogramData struct {
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+// HelpData - data of the help template of a metric
+type HelpData struct {
+	Metric string
+	Tenant string
+	Schema string
+}
+
+// ScrapeFilter - subset of the metrics and tenants requested by a scrape,
+// empty fields select everything
+type ScrapeFilter struct {
+	Metrics []string
+	Tags    []string
+	Group   string
+	Timeout uint
+	Params  map[string]string
+
+	// scrape timeout of the request header, overrides the timeouts above
+	Deadline time.Duration
+}
+
+// true, if the tenant belongs to the filter
+func (filter ScrapeFilter) selects(tenant *TenantInfo) bool {
+
+	// all tags of the filter must be tenant tags
+	if !SubSliceInSlice(filter.Tags, tenant.Tags) {
+		return false
+	}
+	return "" == filter.Group || strings.EqualFold(filter.Group, tenant.Group)
 }
 
 // webCmd represents the web command
@@ -67,17 +229,187 @@ var webCmd = &cobra.Command{
 			exit("Can't handle config file: ", err)
 		}
 
+		// the flag takes precedence over the LogFormat of the configfile
+		if cmd.Flags().Changed("log-format") || "" == config.LogFormat {
+			config.LogFormat, err = cmd.Flags().GetString("log-format")
+			if err != nil {
+				exit("Problem with log-format flag: ", err)
+			}
+		}
+		err = SetLogFormat(config.LogFormat)
+		if err != nil {
+			exit("Problem with log format: ", err)
+		}
+		level, err := cmd.Flags().GetString("log-level")
+		if err != nil {
+			exit("Problem with log-level flag: ", err)
+		}
+		err = SetLogLevel(level)
+		if err != nil {
+			exit("Problem with log-level flag: ", err)
+		}
+
 		config.Timeout, err = cmd.Flags().GetUint("timeout")
 		if err != nil {
 			exit("Problem with timeout flag: ", err)
 		}
+		config.TimeoutBuffer, err = cmd.Flags().GetFloat64("timeout-buffer")
+		if err != nil {
+			exit("Problem with timeout-buffer flag: ", err)
+		}
 		config.port, err = cmd.Flags().GetString("port")
 		if err != nil {
 			exit("Problem with port flag: ", err)
 		}
+		config.MinInterval, err = cmd.Flags().GetUint("min-interval")
+		if err != nil {
+			exit("Problem with min-interval flag: ", err)
+		}
+		config.SourceLabel, err = cmd.Flags().GetBool("source-label")
+		if err != nil {
+			exit("Problem with source-label flag: ", err)
+		}
+		config.InstanceLabel, err = cmd.Flags().GetBool("instance-label")
+		if err != nil {
+			exit("Problem with instance-label flag: ", err)
+		}
+		config.Instance, err = cmd.Flags().GetString("instance")
+		if err != nil {
+			exit("Problem with instance flag: ", err)
+		}
+		config.TagsLabel, err = cmd.Flags().GetBool("tags-label")
+		if err != nil {
+			exit("Problem with tags-label flag: ", err)
+		}
+		config.FailStatus, err = cmd.Flags().GetInt("fail-status")
+		if err != nil {
+			exit("Problem with fail-status flag: ", err)
+		}
+		config.Oneshot, err = cmd.Flags().GetBool("oneshot")
+		if err != nil {
+			exit("Problem with oneshot flag: ", err)
+		}
+		config.LogInterval, err = cmd.Flags().GetUint("log-interval")
+		if err != nil {
+			exit("Problem with log-interval flag: ", err)
+		}
+		config.LogFilter, err = cmd.Flags().GetStringSlice("log-metrics")
+		if err != nil {
+			exit("Problem with log-metrics flag: ", err)
+		}
+		config.LogOnly, err = cmd.Flags().GetBool("log-only")
+		if err != nil {
+			exit("Problem with log-only flag: ", err)
+		}
+		config.TableSizes, err = cmd.Flags().GetUint("table-sizes")
+		if err != nil {
+			exit("Problem with table-sizes flag: ", err)
+		}
+		config.InitTimeout, err = cmd.Flags().GetFloat64("init-timeout")
+		if err != nil {
+			exit("Problem with init-timeout flag: ", err)
+		}
+		config.ConnectRetries, err = cmd.Flags().GetUint("connect-retries")
+		if err != nil {
+			exit("Problem with connect-retries flag: ", err)
+		}
+		config.RetryInterval, err = cmd.Flags().GetFloat64("connect-retry-interval")
+		if err != nil {
+			exit("Problem with connect-retry-interval flag: ", err)
+		}
+		config.RetryMaxWait, err = cmd.Flags().GetFloat64("connect-retry-max-wait")
+		if err != nil {
+			exit("Problem with connect-retry-max-wait flag: ", err)
+		}
+		config.RecheckInterval, err = cmd.Flags().GetUint("recheck-interval")
+		if err != nil {
+			exit("Problem with recheck-interval flag: ", err)
+		}
+		config.TenantConcurrency, err = cmd.Flags().GetUint("tenant-concurrency")
+		if err != nil {
+			exit("Problem with tenant-concurrency flag: ", err)
+		}
+		if cmd.Flags().Changed("query-concurrency") {
+			config.QueryConcurrency, err = cmd.Flags().GetUint("query-concurrency")
+			if err != nil {
+				exit("Problem with query-concurrency flag: ", err)
+			}
+		}
+		config.MaxScrapeDuration, err = cmd.Flags().GetFloat64("max-scrape-duration")
+		if err != nil {
+			exit("Problem with max-scrape-duration flag: ", err)
+		}
+		config.WatchdogTimeout, err = cmd.Flags().GetFloat64("watchdog-timeout")
+		if err != nil {
+			exit("Problem with watchdog-timeout flag: ", err)
+		}
+		config.DefaultUsage, err = cmd.Flags().GetString("default-usage")
+		if err != nil {
+			exit("Problem with default-usage flag: ", err)
+		}
+		config.QueryComment, err = cmd.Flags().GetBool("query-comment")
+		if err != nil {
+			exit("Problem with query-comment flag: ", err)
+		}
+		config.TenantPrefix, err = cmd.Flags().GetBool("tenant-prefix")
+		if err != nil {
+			exit("Problem with tenant-prefix flag: ", err)
+		}
+		config.ErrorBuffer, err = cmd.Flags().GetUint("error-buffer")
+		if err != nil {
+			exit("Problem with error-buffer flag: ", err)
+		}
+		config.DebugToken, err = cmd.Flags().GetString("debug-token")
+		if err != nil {
+			exit("Problem with debug-token flag: ", err)
+		}
+		config.SecretInterval, err = cmd.Flags().GetUint("secret-interval")
+		if err != nil {
+			exit("Problem with secret-interval flag: ", err)
+		}
+		config.OTLPEndpoint, err = cmd.Flags().GetString("otlp-endpoint")
+		if err != nil {
+			exit("Problem with otlp-endpoint flag: ", err)
+		}
+		config.OTLPInterval, err = cmd.Flags().GetUint("otlp-interval")
+		if err != nil {
+			exit("Problem with otlp-interval flag: ", err)
+		}
+		config.GraphiteEndpoint, err = cmd.Flags().GetString("graphite-endpoint")
+		if err != nil {
+			exit("Problem with graphite-endpoint flag: ", err)
+		}
+		config.GraphiteInterval, err = cmd.Flags().GetUint("graphite-interval")
+		if err != nil {
+			exit("Problem with graphite-interval flag: ", err)
+		}
+		config.GraphiteTemplate, err = cmd.Flags().GetString("graphite-template")
+		if err != nil {
+			exit("Problem with graphite-template flag: ", err)
+		}
+		config.ShutdownGrace, err = cmd.Flags().GetUint("shutdown-grace")
+		if err != nil {
+			exit("Problem with shutdown-grace flag: ", err)
+		}
+		config.WebCertFile, err = cmd.Flags().GetString("web-cert-file")
+		if err != nil {
+			exit("Problem with web-cert-file flag: ", err)
+		}
+		config.WebKeyFile, err = cmd.Flags().GetString("web-key-file")
+		if err != nil {
+			exit("Problem with web-key-file flag: ", err)
+		}
+		if ("" == config.WebCertFile) != ("" == config.WebKeyFile) {
+			exit("Problem with web-cert-file and web-key-file flags: ", errors.New("both or none must be set"))
+		}
+		config.ReconnectInterval, err = cmd.Flags().GetUint("reconnect-interval")
+		if err != nil {
+			exit("Problem with reconnect-interval flag: ", err)
+		}
 
-		// set data func
+		// set data and connect func
 		config.DataFunc = config.GetMetricData
+		config.ConnectFunc = config.ConnectTenant
 
 		err = config.Web()
 		if err != nil {
@@ -88,21 +420,72 @@ var webCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(webCmd)
+	prometheus.MustRegister(handlerErrors)
 
 	webCmd.PersistentFlags().UintP("timeout", "t", 5, "scrape timeout of the hana_sql_exporter in seconds.")
+	webCmd.PersistentFlags().Float64("timeout-buffer", 0.5, "seconds subtracted from the scrape timeout to leave time for the response.")
 	webCmd.PersistentFlags().StringP("port", "p", "9658", "port, the hana_sql_exporter listens to.")
+	webCmd.PersistentFlags().UintP("min-interval", "m", 0, "minimum interval in seconds between two collections, faster scrapes get the last result.")
+	webCmd.PersistentFlags().Bool("source-label", false, "add the label source (live or cache) to the metrics guarded by the minimum interval.")
+	webCmd.PersistentFlags().Bool("instance-label", false, "add the label instance to all metrics.")
+	webCmd.PersistentFlags().String("instance", "", "value of the instance label (default hostname of the exporter).")
+	webCmd.PersistentFlags().Bool("tags-label", false, "add the joined tenant tags as label to every metric.")
+	webCmd.PersistentFlags().Int("fail-status", http.StatusOK, "http status of /metrics, if no metric could be collected at all (e.g. 500).")
+	webCmd.PersistentFlags().Bool("oneshot", false, "collect the metrics once, print them to stdout and exit.")
+	webCmd.PersistentFlags().Uint("log-interval", 0, "interval in seconds for writing the metric values to the log, 0 disables the log sink.")
+	webCmd.PersistentFlags().StringSlice("log-metrics", nil, "names of the metrics written to the log (default all).")
+	webCmd.PersistentFlags().String("log-level", "info", "level of the log: debug, info, warn or error. Debug logs the sql and the number of records of every query.")
+	webCmd.PersistentFlags().String("log-format", "text", "format of the log: text or json, overrides LogFormat of the configfile.")
+	webCmd.PersistentFlags().Bool("log-only", false, "only write the metrics to the log without starting the web server.")
+	webCmd.PersistentFlags().Float64("init-timeout", 10, "timeout in seconds for the setup and discovery queries of a tenant connection.")
+	webCmd.PersistentFlags().Uint("connect-retries", 0, "number of connect retries with exponential backoff for tenants, which are down at startup.")
+	webCmd.PersistentFlags().Float64("connect-retry-interval", 1, "seconds before the first connect retry, doubled for every further retry.")
+	webCmd.PersistentFlags().Float64("connect-retry-max-wait", 60, "maximum seconds the startup waits for connect retries altogether.")
+	webCmd.PersistentFlags().Uint("recheck-interval", 3600, "seconds after which metrics with missing objects are tried again, 0 disables the recheck.")
+	webCmd.PersistentFlags().Uint("tenant-concurrency", 0, "maximum number of tenants queried in parallel for a metric, 0 means no limit.")
+	webCmd.PersistentFlags().Uint("query-concurrency", 0, "maximum number of queries running in parallel across all metrics and tenants, overrides QueryConcurrency of the configfile, 0 means no limit.")
+	webCmd.PersistentFlags().Float64("max-scrape-duration", 0, "hard ceiling in seconds of the whole collection, after which partial results are returned (default no ceiling).")
+	webCmd.PersistentFlags().Float64("watchdog-timeout", 60, "seconds after which a hanging collection is cancelled with a stack dump, at least twice the scrape timeout, 0 disables the watchdog.")
+	webCmd.PersistentFlags().String("default-usage", "unknown", "usage label of tenants, whose usage can't be selected from m_database.")
+	webCmd.PersistentFlags().Bool("query-comment", false, "prepend a comment with metric and tenant to every query for tracing in hana.")
+	webCmd.PersistentFlags().Bool("tenant-prefix", false, "prefix the metric names with the tenant name, unless the tenant has its own MetricPrefix.")
+	webCmd.PersistentFlags().Uint("error-buffer", 100, "number of recent collection errors provided by /debug/errors.")
+	webCmd.PersistentFlags().String("debug-token", "", "bearer token required for /debug/errors (default no authorization).")
+	webCmd.PersistentFlags().Uint("secret-interval", 0, "interval in seconds for reading the secret of the configfile again, tenants with changed password are reconnected, 0 disables the refresh.")
+	webCmd.PersistentFlags().String("otlp-endpoint", "", "otlp/http endpoint, the metrics are pushed to, e.g. http://collector:4318/v1/metrics (default no push).")
+	webCmd.PersistentFlags().Uint("otlp-interval", 60, "interval in seconds for pushing the metrics to the otlp endpoint.")
+	webCmd.PersistentFlags().String("graphite-endpoint", "", "carbon endpoint <host>:<port>, the metrics are pushed to in graphite plaintext format (default no push).")
+	webCmd.PersistentFlags().Uint("graphite-interval", 60, "interval in seconds for pushing the metrics to the carbon endpoint.")
+	webCmd.PersistentFlags().String("graphite-template", "hana.{tenant}.{metric}", "template of the graphite paths with the placeholders {metric} and {<label>}.")
+	webCmd.PersistentFlags().Uint("reconnect-interval", 30, "minimum seconds between two reconnects of a tenant, so that a down tenant isn't reconnected at every scrape, 0 disables the limit.")
+	webCmd.PersistentFlags().String("web-cert-file", "", "certificate file of the web server, which serves https with the key file.")
+	webCmd.PersistentFlags().String("web-key-file", "", "private key file of the web server, which serves https with the certificate file.")
+	webCmd.PersistentFlags().Uint("shutdown-grace", 30, "grace period in seconds for running scrapes on SIGTERM or SIGINT, before the tenant connections are closed.")
+	webCmd.PersistentFlags().Uint("table-sizes", 0, "number of largest tables per tenant, whose sizes are exported, 0 disables the table size metrics.")
 }
 
 // create new collector
-func newCollector(stats func() []MetricData) *collector {
+func newCollector(stats func() []MetricData, instance string) *collector {
 	return &collector{
-		stats: stats,
+		stats:     stats,
+		instance:  instance,
+		limitHits: make(map[string]float64),
+	}
+}
+
+// constant instance label, unless disabled or the record has its own
+func (c *collector) constLabels(labels []string) prometheus.Labels {
+	if "" == c.instance || ContainsString("instance", labels) {
+		return nil
 	}
+	return prometheus.Labels{"instance": c.instance}
 }
 
-// Describe - describe implements prometheus.Collector.
+// Describe - describe implements prometheus.Collector. No descriptions are
+// sent, because the metrics are only known after the collection. This makes it
+// an unchecked collector and avoids a complete collection during the
+// registration, which would also count as sample limit hit.
 func (c *collector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(c, ch)
 }
 
 // Collect - implements prometheus.Collector.
@@ -115,45 +498,261 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		"counter": prometheus.CounterValue,
 	}
 
+	// number of emitted series
+	var series int
+
 	for _, mi := range stats {
-		for _, v := range mi.Stats {
-			m := prometheus.MustNewConstMetric(
-				prometheus.NewDesc(mi.Name, mi.Help, v.Labels, nil),
-				valueType[low(mi.MetricType)],
-				v.Value,
-				v.LabelValues...,
-			)
+		samples := mi.Stats
+		helps := familyHelps(mi)
+
+		// last line of defense against one metric dominating the scrape
+		if mi.SampleLimit > 0 && uint(len(samples)) > mi.SampleLimit {
+			log.WithFields(log.Fields{
+				"metric":  mi.Name,
+				"samples": len(samples),
+				"limit":   mi.SampleLimit,
+			}).Warn("Sample limit of metric exceeded - samples truncated.")
+
+			samples = samples[:mi.SampleLimit]
+			c.mu.Lock()
+			c.limitHits[mi.Name]++
+			c.mu.Unlock()
+		}
+
+		for _, v := range samples {
+
+			// records of tenants with metric prefix or of value columns get
+			// their own metric name
+			name := v.MetricName(mi.Name)
+			desc := prometheus.NewDesc(name, helps[name], v.Labels, c.constLabels(v.Labels))
+			var m prometheus.Metric
+			if nil != v.Histogram {
+				m = prometheus.MustNewConstHistogram(desc, v.Histogram.Count, v.Histogram.Sum, v.Histogram.Buckets, v.LabelValues...)
+			} else if nil != v.Summary {
+				m = prometheus.MustNewConstSummary(desc, v.Summary.Count, v.Summary.Sum, v.Summary.Quantiles, v.LabelValues...)
+			} else {
+				m = prometheus.MustNewConstMetric(desc, valueType[low(mi.MetricType)], v.Value, v.LabelValues...)
+			}
+
+			// samples of a time column carry the time of the measurement
+			if !v.Timestamp.IsZero() {
+				m = prometheus.NewMetricWithTimestamp(v.Timestamp, m)
+			}
 			ch <- m
+			series++
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, hits := range c.limitHits {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("hana_sql_exporter_sample_limit_hits_total", "Number of scrapes, in which the samples of the metric were truncated to the sample limit.", []string{"metric"}, c.constLabels(nil)),
+			prometheus.CounterValue,
+			hits,
+			name,
+		)
+		series++
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("hana_sql_exporter_scraped_series", "Number of series emitted by the scrape without this one.", nil, c.constLabels(nil)),
+		prometheus.GaugeValue,
+		float64(series),
+	)
+}
+
+// help texts of the metric families of the metric - a family gets the joined
+// tenants and schemas of its records
+func familyHelps(mi MetricData) map[string]string {
+
+	var names []string
+	data := make(map[string]*HelpData)
+	for _, v := range mi.Stats {
+		name := v.MetricName(mi.Name)
+		hd, ok := data[name]
+		if !ok {
+			hd = &HelpData{Metric: name}
+			data[name] = hd
+			names = append(names, name)
+		}
+		hd.Tenant = joinDistinct(hd.Tenant, v.Tenant)
+		hd.Schema = joinDistinct(hd.Schema, v.Schema)
+	}
+
+	helps := make(map[string]string)
+	for _, name := range names {
+		help, err := RenderHelp(mi.Help, *data[name])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"metric": name,
+				"error":  err,
+			}).Error("Can't render help template of metric")
+			help = mi.Help
 		}
+		helps[name] = help
+	}
+	return helps
+}
+
+// append the value to the comma separated list, if it is new
+func joinDistinct(list, value string) string {
+	if "" == value || ContainsString(value, strings.Split(list, ",")) {
+		return list
+	}
+	if "" == list {
+		return value
+	}
+	return list + "," + value
+}
+
+// RenderHelp - interpolate the help template of a metric
+func RenderHelp(help string, data HelpData) (string, error) {
+	if !strings.Contains(help, "{{") {
+		return help, nil
+	}
+
+	tmpl, err := template.New("help").Parse(help)
+	if err != nil {
+		return "", errors.Wrap(err, "RenderHelp(Parse)")
 	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, data)
+	if err != nil {
+		return "", errors.Wrap(err, "RenderHelp(Execute)")
+	}
+	return b.String(), nil
 }
 
 // Web - start collector and web server
 func (config *Config) Web() error {
 	var err error
 
-	config.Tenants, err = config.prepare()
+	err = config.ValidateMetrics()
+	if err != nil {
+		exit("Invalid metric definition: ", err)
+	}
+
+	err = config.ResolveInstance()
+	if err != nil {
+		exit("Invalid instance label: ", err)
+	}
+
+	// hash of the configuration before it is changed by the preparation
+	config.hash, err = config.ConfigHash()
+	if err != nil {
+		exit("Can't hash config: ", err)
+	}
+
+	// opt-in metrics with the sizes of the largest tables
+	if config.TableSizes > 0 {
+		config.Metrics = append(config.Metrics, TableSizeMetrics(config.TableSizes)...)
+	}
+
+	config.Tenants, err = config.Prepare()
 	if err != nil {
 		exit("Preparation of tenants not possible: ", err)
 	}
 
-	// close tenant connections at the end
-	for i := range config.Tenants {
-		defer config.Tenants[i].conn.Close()
+	// hana and the exporter may start together
+	config.RetryConnect()
+
+	// collect once and print the result without starting the web server
+	if config.Oneshot {
+		err = config.WriteMetrics(os.Stdout)
+		config.CloseConnections()
+		return err
+	}
+
+	// rotated passwords are picked up without restart
+	if config.SecretInterval > 0 {
+		ticker := time.NewTicker(time.Duration(config.SecretInterval) * time.Second)
+		defer ticker.Stop()
+		go config.SecretRefresher(ticker.C, readSecret)
+	}
+
+	// push the metrics periodically to an otlp endpoint
+	if "" != config.OTLPEndpoint {
+		if config.OTLPInterval == 0 {
+			exit("Invalid otlp interval: ", errors.New("interval must be positive"))
+		}
+		endpoint, err := url.Parse(config.OTLPEndpoint)
+		if err != nil || ("http" != endpoint.Scheme && "https" != endpoint.Scheme) {
+			exit("Invalid otlp endpoint: ", errors.Errorf("%s is no http(s) url", config.OTLPEndpoint))
+		}
+		ticker := time.NewTicker(time.Duration(config.OTLPInterval) * time.Second)
+		defer ticker.Stop()
+		go config.OTLPPush(ticker.C)
+	}
+
+	// push the metrics periodically to a carbon endpoint
+	if "" != config.GraphiteEndpoint {
+		if config.GraphiteInterval == 0 {
+			exit("Invalid graphite interval: ", errors.New("interval must be positive"))
+		}
+		_, _, err := net.SplitHostPort(config.GraphiteEndpoint)
+		if err != nil {
+			exit("Invalid graphite endpoint: ", err)
+		}
+		err = ValidateGraphiteTemplate(config.GraphiteTemplate)
+		if err != nil {
+			exit("Invalid graphite template: ", err)
+		}
+		ticker := time.NewTicker(time.Duration(config.GraphiteInterval) * time.Second)
+		defer ticker.Stop()
+		go config.GraphiteSink(ticker.C)
 	}
 
-	stats := func() []MetricData {
-		return config.CollectMetrics()
+	// write the metric values periodically to the log
+	if config.LogInterval > 0 {
+		ticker := time.NewTicker(time.Duration(config.LogInterval) * time.Second)
+		defer ticker.Stop()
+
+		if config.LogOnly {
+			config.LogSink(ticker.C)
+			config.CloseConnections()
+			return nil
+		}
+		go config.LogSink(ticker.C)
 	}
 
+	// tenants and metrics are reloaded from the config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go config.ConfigReloader(hup, getConfig)
+
+	// first collection in the background for the readiness
+	config.WarmUp()
+
 	// start collector
-	c := newCollector(stats)
+	c := newCollector(config.stats, config.instanceLabel())
 	prometheus.MustRegister(c)
 
+	// the write timeout covers the longest scrape of the tenant groups
+	maxTimeout := config.Timeout
+	for _, group := range config.Groups {
+		if group.Timeout > maxTimeout {
+			maxTimeout = group.Timeout
+		}
+	}
+	writeTimeout := time.Duration(maxTimeout+2) * time.Second
+	config.writeBudget = writeTimeout - writeMargin
+
 	// start http server
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", config.FilterHandler(config.MetricsHandler(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, DeadlineHandler(prometheus.DefaultGatherer, config.writeBudget)))))
 	mux.HandleFunc("/", RootHandler)
+	mux.Handle("/debug/errors", config.ErrorsHandler())
+	mux.Handle("/ready", config.ReadyHandler())
+	mux.HandleFunc("/healthz", HealthzHandler)
+	mux.Handle("/readyz", config.ReadyzHandler(probeTimeout))
+	mux.Handle("/descriptors", config.DescriptorsHandler())
+
+	// separate endpoints for the tenant groups
+	for _, group := range config.Groups {
+		mux.Handle("/metrics/"+low(group.Name), config.GroupHandler(group))
+	}
 
 	// Add the pprof routes
 	// mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -170,270 +769,3272 @@ func (config *Config) Web() error {
 	server := &http.Server{
 		Addr:         ":" + config.port,
 		Handler:      mux,
-		WriteTimeout: time.Duration(config.Timeout+2) * time.Second,
-		ReadTimeout:  time.Duration(config.Timeout+2) * time.Second,
+		WriteTimeout: writeTimeout,
+		ReadTimeout:  writeTimeout,
+	}
+
+	// https with the minimum version and cipher suites of the global tls settings
+	if "" != config.WebCertFile {
+		server.TLSConfig, err = config.ServerTLSConfig()
+		if err != nil {
+			config.CloseConnections()
+			return errors.Wrap(err, "web(ServerTLSConfig)")
+		}
 	}
-	err = server.ListenAndServe()
+
+	// on SIGTERM or SIGINT running scrapes are finished and the tenant
+	// connections are closed, so that no hana sessions are left behind
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	done := make(chan error, 1)
+	go func() {
+		done <- config.Shutdown(server, stop, time.Duration(config.ShutdownGrace)*time.Second)
+	}()
+
+	// systemd socket activation passes the listening socket, otherwise the
+	// port is bound by the exporter itself
+	listener, err := ActivationListener(os.Getenv, listenFDsStart)
 	if err != nil {
+		config.CloseConnections()
+		return errors.Wrap(err, "web(ActivationListener)")
+	}
+	if listener != nil {
+		log.WithFields(log.Fields{
+			"address": listener.Addr().String(),
+		}).Info("Serving on socket activated listener.")
+		if "" != config.WebCertFile {
+			err = server.ServeTLS(listener, config.WebCertFile, config.WebKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+	} else if "" != config.WebCertFile {
+		err = server.ListenAndServeTLS(config.WebCertFile, config.WebKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		config.CloseConnections()
 		return errors.Wrap(err, "web(ListenAndServe)")
 	}
-	return nil
+	return <-done
 }
 
-// RootHandler - message, when calling mithout /metrics
-func RootHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "prometheus hana_sql_exporter: please call <host>:<port>/metrics")
-}
+// Shutdown - stop the web server after the signal. Running scrapes get the
+// grace period to finish, afterwards the tenant connections are closed.
+func (config *Config) Shutdown(server *http.Server, sig <-chan os.Signal, grace time.Duration) error {
+	s := <-sig
+	log.WithFields(log.Fields{
+		"signal": s.String(),
+		"grace":  grace.String(),
+	}).Info("Shutting down.")
 
-// CollectMetrics - collecting all metrics and fetch the results
-func (config *Config) CollectMetrics() []MetricData {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	config.CloseConnections()
+	if err != nil {
+		return errors.Wrap(err, "Shutdown(server.Shutdown)")
+	}
+	return nil
+}
 
-	var wg sync.WaitGroup
-	metricCnt := len(config.Metrics)
-	metricsC := make(chan MetricData, metricCnt)
+// first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
 
-	for mPos := range config.Metrics {
+// ActivationListener - listener of the first socket passed by systemd socket
+// activation at the file descriptor fd. Nil, if the exporter was not socket
+// activated, i.e. LISTEN_PID isn't the pid of the exporter or LISTEN_FDS is unset.
+func ActivationListener(getenv func(string) string, fd uintptr) (net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	cnt, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || cnt < 1 {
+		return nil, nil
+	}
 
-		wg.Add(1)
-		go func(mPos int) {
+	f := os.NewFile(fd, "LISTEN_FD_"+strconv.Itoa(int(fd)))
+	if f == nil {
+		return nil, errors.Errorf("ActivationListener(invalid file descriptor %d)", fd)
+	}
+	defer f.Close()
 
-			defer wg.Done()
-			metricsC <- MetricData{
-				Name:       config.Metrics[mPos].Name,
-				Help:       config.Metrics[mPos].Help,
-				MetricType: config.Metrics[mPos].MetricType,
-				Stats:      config.CollectMetric(mPos),
-			}
-		}(mPos)
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "ActivationListener(FileListener)")
 	}
+	return listener, nil
+}
 
-	go func() {
-		wg.Wait()
-		close(metricsC)
-	}()
+// ResolveInstance - set the instance label to the hostname of the exporter,
+// if it is enabled without value, and validate it
+func (config *Config) ResolveInstance() error {
+	if !config.InstanceLabel {
+		return nil
+	}
 
-	var metricsData []MetricData
-	for metric := range metricsC {
-		if metric.Stats != nil {
-			metricsData = append(metricsData, metric)
+	if "" == config.Instance {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "ResolveInstance(Hostname)")
 		}
+		config.Instance = hostname
 	}
+	if "" == strings.TrimSpace(config.Instance) || len(config.Instance) > maxLabelValueLength || !utf8.ValidString(config.Instance) {
+		return errors.Errorf("ResolveInstance(invalid label value %q)", config.Instance)
+	}
+	return nil
+}
 
-	return metricsData
+// value of the instance label, empty if disabled
+func (config *Config) instanceLabel() string {
+	if !config.InstanceLabel {
+		return ""
+	}
+	return config.Instance
 }
 
-// CollectMetric - collecting one metric for every tenants
-func (config *Config) CollectMetric(mPos int) []MetricRecord {
+// all metrics of a scrape
+func (config *Config) stats() []MetricData {
+	var md []MetricData
+	md = append(md, config.GuardedMetrics()...)
+	return append(md, config.ExporterMetrics()...)
+}
 
-	// set timeout
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(config.Timeout)*time.Second))
-	defer cancel()
+// WriteMetrics - collect the metrics once and write them in prometheus text format
+func (config *Config) WriteMetrics(w io.Writer) error {
 
-	tenantCnt := len(config.Tenants)
-	metricC := make(chan []MetricRecord, tenantCnt)
+	reg := prometheus.NewRegistry()
+	err := reg.Register(newCollector(config.stats, config.instanceLabel()))
+	if err != nil {
+		return errors.Wrap(err, "WriteMetrics(Register)")
+	}
 
+	mfs, err := reg.Gather()
+	if err != nil {
+		return errors.Wrap(err, "WriteMetrics(Gather)")
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		err = enc.Encode(mf)
+		if err != nil {
+			return errors.Wrap(err, "WriteMetrics(Encode)")
+		}
+	}
+	return nil
+}
+
+// LogSink - collect the metrics at every tick and write the values of the
+// selected metrics to the log. Records of tenants with metric prefix or of
+// value columns are selected and logged by their own metric name.
+func (config *Config) LogSink(tick <-chan time.Time) {
+	for range tick {
+		for _, md := range config.GuardedMetrics() {
+			for _, record := range md.Stats {
+				name := record.MetricName(md.Name)
+				if len(config.LogFilter) > 0 && !ContainsString(name, config.LogFilter) {
+					continue
+				}
+				fields := log.Fields{
+					"metric": name,
+					"value":  record.Value,
+				}
+				for i, label := range record.Labels {
+					if i < len(record.LabelValues) {
+						fields[label] = record.LabelValues[i]
+					}
+				}
+				log.WithFields(fields).Info("Metric value")
+			}
+		}
+	}
+}
+
+// FilterHandler - scrapes with the query parameters metric or tag (comma
+// separated) get only the matching subset of the configured metrics
+func (config *Config) FilterHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := ScrapeFilter{
+			Metrics: queryValues(r, "metric"),
+			Tags:    queryValues(r, "tag"),
+		}
+		params, err := config.ScrapeParams(r, filter.Metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Params = params
+		filter.Deadline = config.HeaderTimeout(r)
+		if len(filter.Metrics) == 0 && len(filter.Tags) == 0 && len(filter.Params) == 0 {
+			config.setRequestTimeout(filter.Deadline)
+			next.ServeHTTP(w, r)
+			return
+		}
+		config.serveFiltered(w, r, filter)
+	})
+}
+
+// GroupHandler - scrapes of the tenants of one group with the timeout of the group
+func (config *Config) GroupHandler(group GroupInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := queryValues(r, "metric")
+		params, err := config.ScrapeParams(r, metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config.serveFiltered(w, r, ScrapeFilter{
+			Metrics:  metrics,
+			Tags:     queryValues(r, "tag"),
+			Group:    group.Name,
+			Timeout:  group.Timeout,
+			Params:   params,
+			Deadline: config.HeaderTimeout(r),
+		})
+	})
+}
+
+// respond with the metrics of the filter
+func (config *Config) serveFiltered(w http.ResponseWriter, r *http.Request, filter ScrapeFilter) {
+
+	// the fail status depends on the result of this collection
+	var md []MetricData
+	reg := prometheus.NewRegistry()
+	err := reg.Register(newCollector(func() []MetricData {
+		md = config.FilteredMetrics(filter)
+		return md
+	}, config.instanceLabel()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if config.FailStatus != 0 && config.FailStatus != http.StatusOK {
+		w = &statusWriter{ResponseWriter: w, status: config.FailStatus, empty: func() bool {
+			return !collected(md)
+		}}
+	}
+	DeadlineHandler(reg, config.writeBudget).ServeHTTP(w, r)
+}
+
+// DeadlineHandler - write the gathered metric families in the negotiated
+// format like promhttp.HandlerFor. When the budget since the start of the
+// request is used up, the remaining families are dropped and the truncation
+// marker with their number is written instead, so that the response is
+// complete before the write timeout of the server cuts it off. A budget of 0
+// means no limit.
+func DeadlineHandler(g prometheus.Gatherer, budget time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// like promhttp, gather errors fail the request
+		mfs, err := g.Gather()
+		if err != nil {
+			handlerErrors.WithLabelValues("gathering").Inc()
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Error while gathering metrics.")
+			http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Accept-Encoding")
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		flusher, _ := w.(http.Flusher)
+
+		enc := expfmt.NewEncoder(out, format)
+		for i, mf := range mfs {
+			if budget > 0 && time.Since(start) > budget {
+				omitted := len(mfs) - i
+				log.WithFields(log.Fields{
+					"omitted": omitted,
+					"budget":  budget.String(),
+				}).Warn("Metrics response truncated before the write timeout.")
+
+				// the marker is gathered, so that it is encoded in the negotiated format
+				marker := prometheus.NewRegistry()
+				marker.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+					Name: scrapeTruncatedName,
+					Help: "Number of metric families omitted to finish the response before the write timeout.",
+				}, func() float64 { return float64(omitted) }))
+				markers, _ := marker.Gather()
+				for _, m := range markers {
+					enc.Encode(m)
+				}
+				return
+			}
+			if err := enc.Encode(mf); err != nil {
+				handlerErrors.WithLabelValues("encoding").Inc()
+				log.WithFields(log.Fields{
+					"metric": mf.GetName(),
+					"error":  err,
+				}).Error("Error while writing metrics.")
+				return
+			}
+			if gz, ok := out.(*gzip.Writer); ok {
+				gz.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// comma separated values of a query parameter
+func queryValues(r *http.Request, key string) []string {
+	var values []string
+	for _, param := range r.URL.Query()[key] {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); "" != value {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// ScrapeParams - scrape-time parameters of the request (query parameters
+// param_<name>), which must be declared by one of the requested metrics
+func (config *Config) ScrapeParams(r *http.Request, metrics []string) (map[string]string, error) {
+	var params map[string]string
+	for key, values := range r.URL.Query() {
+		if !strings.HasPrefix(key, "param_") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "param_")
+		if !config.paramDeclared(name, metrics) {
+			return nil, errors.Errorf("parameter %s is not declared by a requested metric", name)
+		}
+		if len(values) != 1 || len(values[0]) > maxLabelValueLength {
+			return nil, errors.Errorf("parameter %s needs exactly one value with at most %d characters", name, maxLabelValueLength)
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = values[0]
+	}
+	return params, nil
+}
+
+// true, if one of the metrics (default all) declares the parameter
+func (config *Config) paramDeclared(name string, metrics []string) bool {
+	for _, metric := range config.Metrics {
+		if len(metrics) > 0 && !ContainsString(metric.Name, metrics) {
+			continue
+		}
+		if ContainsString(name, metric.Params) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricArgs - bind arguments of the metric in the order of its declared
+// parameters, false if a parameter is missing in the running collection
+func (config *Config) MetricArgs(mPos int) ([]interface{}, bool) {
+	config.paramMu.Lock()
+	defer config.paramMu.Unlock()
+
+	var args []interface{}
+	for _, name := range config.Metrics[mPos].Params {
+		value, ok := config.params[name]
+		if !ok {
+			return nil, false
+		}
+		args = append(args, value)
+	}
+	return args, true
+}
+
+// set the scrape-time parameters of the running collection
+func (config *Config) setParams(params map[string]string) {
+	config.paramMu.Lock()
+	defer config.paramMu.Unlock()
+
+	config.params = params
+}
+
+// MetricsHandler - respond with the configured fail status, if the collection
+// of the scrape did not return any metric at all. The filtered and group
+// scrapes get the fail status by their own collection.
+func (config *Config) MetricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.FailStatus == 0 || config.FailStatus == http.StatusOK {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&statusWriter{ResponseWriter: w, status: config.FailStatus, empty: config.nothingCollected}, r)
+	})
+}
+
+// statusWriter - replaces the status of the response, when the headers are written
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	empty       func() bool
+	wroteHeader bool
+}
+
+// WriteHeader - the metrics are already collected at this point
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+
+	if code == http.StatusOK && sw.empty() {
+		code = sw.status
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write - write header implicitly like the standard response writer
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush - write header implicitly and flush the response, so that the deadline
+// handler can send the families early
+func (sw *statusWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// true, if the last collection did not return any metric
+func (config *Config) nothingCollected() bool {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	return !collected(config.lastMetrics)
+}
+
+// true, if a configured metric has records. The markers of partial or stalled
+// collections and the metrics of the exporter itself don't count.
+func collected(md []MetricData) bool {
+	for _, metric := range md {
+		if len(metric.Stats) > 0 && !strings.HasPrefix(metric.Name, "hana_sql_exporter_") {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectError - error of a collection for the diagnostics endpoint
+type CollectError struct {
+	Time    time.Time `json:"time"`
+	Tenant  string    `json:"tenant"`
+	Metric  string    `json:"metric"`
+	Message string    `json:"message"`
+}
+
+// RecordError - keep the error in the buffer of the recent collection errors
+func (config *Config) RecordError(metric, tenant string, err error) {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	now := time.Now()
+
+	// time of the last error per metric and tenant
+	if config.lastErrors == nil {
+		config.lastErrors = make(map[[2]string]time.Time)
+	}
+	config.lastErrors[[2]string{metric, low(tenant)}] = now
+
+	if config.ErrorBuffer == 0 {
+		return
+	}
+
+	config.recentErrors = append(config.recentErrors, CollectError{
+		Time:    now,
+		Tenant:  low(tenant),
+		Metric:  metric,
+		Message: err.Error(),
+	})
+
+	// drop the oldest errors
+	if over := len(config.recentErrors) - int(config.ErrorBuffer); over > 0 {
+		config.recentErrors = append(config.recentErrors[:0], config.recentErrors[over:]...)
+	}
+}
+
+// CountError - count the failed collection of the metric for the tenant per reason
+func (config *Config) CountError(metric, tenant, reason string) {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	if config.errorCounts == nil {
+		config.errorCounts = make(map[[3]string]float64)
+	}
+	config.errorCounts[[3]string{metric, low(tenant), reason}]++
+}
+
+// ReadErrorReason - reason of an error reading the result of a metric
+func ReadErrorReason(err error) string {
+	if errors.Is(err, errValueNotNumeric) {
+		return "value_column"
+	}
+	return "read"
+}
+
+// ErrorCountMetrics - failed collections per metric, tenant and reason since the start
+func (config *Config) ErrorCountMetrics() MetricData {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	md := MetricData{
+		Name:       "hana_scrape_errors_total",
+		Help:       "Number of failed collections of the metric and tenant per reason.",
+		MetricType: "counter",
+	}
+	for key, cnt := range config.errorCounts {
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       cnt,
+			Labels:      []string{"metric", "tenant", "reason"},
+			LabelValues: []string{key[0], key[1], key[2]},
+		})
+	}
+	return md
+}
+
+// RecentErrors - copy of the recent collection errors, oldest first
+func (config *Config) RecentErrors() []CollectError {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	return append([]CollectError{}, config.recentErrors...)
+}
+
+// LastErrorMetrics - time of the last error per metric and tenant
+func (config *Config) LastErrorMetrics() MetricData {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	md := MetricData{
+		Name:       "hana_sql_exporter_last_error_timestamp_seconds",
+		Help:       "Unix time of the last collection error of the metric and tenant.",
+		MetricType: "gauge",
+	}
+	for key, t := range config.lastErrors {
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       float64(t.UnixNano()) / 1e9,
+			Labels:      []string{"metric", "tenant"},
+			LabelValues: []string{key[0], key[1]},
+		})
+	}
+	return md
+}
+
+// ErrorsHandler - recent collection errors as json, protected by the debug
+// token, if it is set
+func (config *Config) ErrorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// constant time comparison, so that the token can't be guessed by the
+		// response times
+		if "" != config.DebugToken && 1 != subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+config.DebugToken)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(config.RecentErrors())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Can't encode recent errors")
+		}
+	})
+}
+
+// MetricDescriptor - name, help, type and label keys of a metric, which the
+// exporter can emit
+type MetricDescriptor struct {
+	Name   string   `json:"name"`
+	Help   string   `json:"help"`
+	Type   string   `json:"type"`
+	Labels []string `json:"labels"`
+}
+
+// DescriptorsHandler - list the descriptors of all configured metrics as JSON
+func (config *Config) DescriptorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(config.Descriptors())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Can't encode metric descriptors")
+		}
+	})
+}
+
+// Descriptors - descriptors of the configured metrics without query. Tenants
+// with metric prefix and value columns get their own metric names. The label
+// columns are only known with a LabelColumns allow-list, otherwise the
+// descriptor contains the labels set by the exporter.
+func (config *Config) Descriptors() []MetricDescriptor {
+
+	// metric prefixes of the tenants in the order of appearance
+	var prefixes []string
+	for tPos := range config.Tenants {
+		prefix := config.MetricPrefix(tPos)
+		if !ContainsString(prefix, prefixes) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	var descriptors []MetricDescriptor
+	for _, metric := range config.Metrics {
+		labels := []string{"tenant", "usage"}
+		for _, col := range metric.LabelColumns {
+			if !metric.LabelColumn(col) || ContainsString(col, metric.ValueColumns) || strings.EqualFold(col, metric.ValueColumn) ||
+				strings.EqualFold(col, metric.MaxColumn) || strings.EqualFold(col, metric.TimeColumn) {
+				continue
+			}
+			label, err := StripLabelPrefix(metric.caseOf(col), metric.StripPrefixes)
+			if err != nil {
+				label = metric.caseOf(col)
+			}
+			labels = append(labels, label)
+		}
+		if "" != metric.DescColumn {
+			labels = append(labels, "description")
+		}
+		switch low(metric.MetricType) {
+		case "histogram":
+			labels = append(labels, "le")
+		case "summary":
+			labels = append(labels, "quantile")
+		}
+		if config.TagsLabel {
+			labels = append(labels, "tags")
+		}
+		if config.SourceLabel {
+			labels = append(labels, "source")
+		}
+		if "" != config.instanceLabel() {
+			labels = append(labels, "instance")
+		}
+
+		suffixes := []string{""}
+		if len(metric.ValueColumns) > 0 {
+			suffixes = nil
+			for _, col := range metric.ValueColumns {
+				suffixes = append(suffixes, low(col))
+			}
+		}
+		for _, prefix := range prefixes {
+			for _, suffix := range suffixes {
+				descriptors = append(descriptors, MetricDescriptor{
+					Name:   MetricRecord{Prefix: prefix, Suffix: suffix}.MetricName(metric.Name),
+					Help:   metric.Help,
+					Type:   low(metric.MetricType),
+					Labels: labels,
+				})
+			}
+		}
+	}
+	return descriptors
+}
+
+// ReadyHandler - startup probe, which is not ready until the first complete
+// collection succeeded. Not ready exporters collect in the background at most
+// every warmUpInterval, so that they become ready without scrapes, but
+// frequent probes don't load the tenants.
+func (config *Config) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.Ready() {
+			config.WarmUp()
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ready")
+	})
+}
+
+// HealthzHandler - liveness probe, which answers as soon as the web server is up
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// ReadyzHandler - readiness probe without collection: ready, if a tenant
+// connection answers a ping within the timeout. Unlike the startup probe, it
+// follows the availability of the tenants during the whole runtime.
+func (config *Config) ReadyzHandler(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		if !config.PingTenants(ctx) {
+			http.Error(w, "no tenant available", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ready")
+	})
+}
+
+// PingTenants - true, if a tenant connection answers a ping. The tenants are
+// pinged in parallel, so that a hung tenant only delays the answer until the
+// context is done.
+func (config *Config) PingTenants(ctx context.Context) bool {
+
+	// the connections are replaced by reconnects and reloads meanwhile
+	config.connMu.RLock()
+	var dbs []*sql.DB
+	for i := range config.Tenants {
+		if db := config.Tenants[i].conn; db != nil {
+			dbs = append(dbs, db)
+		}
+	}
+	config.connMu.RUnlock()
+
+	res := make(chan bool, len(dbs))
+	for _, db := range dbs {
+		go func(db *sql.DB) {
+			res <- db.PingContext(ctx) == nil
+		}(db)
+	}
+
+	for range dbs {
+		select {
+		case ok := <-res:
+			if ok {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
+
+// Ready - true after the first complete collection with data
+func (config *Config) Ready() bool {
+	config.readyMu.Lock()
+	defer config.readyMu.Unlock()
+
+	return config.ready
+}
+
+// WarmUp - start a background collection, unless one is still running or
+// the last one started less than warmUpInterval ago
+func (config *Config) WarmUp() {
+	config.readyMu.Lock()
+	defer config.readyMu.Unlock()
+
+	if config.warming || time.Since(config.warmed) < warmUpInterval {
+		return
+	}
+	config.warming = true
+	config.warmed = time.Now()
+	go func() {
+		config.GuardedMetrics()
+
+		config.readyMu.Lock()
+		config.warming = false
+		config.readyMu.Unlock()
+	}()
+}
+
+// RootHandler - message, when calling mithout /metrics
+func RootHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "prometheus hana_sql_exporter: please call <host>:<port>/metrics")
+}
+
+// GuardedMetrics - collect all metrics, but return the last result, if the
+// previous collection is younger than the minimum interval
+func (config *Config) GuardedMetrics() []MetricData {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	if config.MinInterval > 0 && time.Since(config.collected) < time.Duration(config.MinInterval)*time.Second {
+		return config.AddSourceLabel(config.lastMetrics, "cache")
+	}
+
+	config.lastMetrics = config.CollectMetrics()
+	config.collected = time.Now()
+	return config.AddSourceLabel(config.lastMetrics, "live")
+}
+
+// AddSourceLabel - add the label source with the collection method (live or
+// cache) to the metric records, if enabled. The records are copied, so that
+// the cached result stays untouched. Columns can't use the label, as it is
+// reserved, but records, which have it anyway, are kept unchanged instead of
+// getting it twice.
+func (config *Config) AddSourceLabel(md []MetricData, source string) []MetricData {
+	if !config.SourceLabel {
+		return md
+	}
+
+	res := make([]MetricData, len(md))
+	for i, metric := range md {
+		res[i] = metric
+		res[i].Stats = make([]MetricRecord, len(metric.Stats))
+		for j, record := range metric.Stats {
+			if ContainsString("source", record.Labels) {
+				res[i].Stats[j] = record
+				continue
+			}
+			record.Labels = append(append([]string(nil), record.Labels...), "source")
+			record.LabelValues = append(append([]string(nil), record.LabelValues...), source)
+			res[i].Stats[j] = record
+		}
+	}
+	return res
+}
+
+// FilteredMetrics - collect the metrics of the filter. The result is not
+// cached, but the collection is serialized with the guarded collection.
+func (config *Config) FilteredMetrics(filter ScrapeFilter) []MetricData {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	return config.CollectFilteredMetrics(filter)
+}
+
+// ReviveTenants - check the connections of the tenants of the filter and
+// reconnect the ones, which are down or don't answer, in the background. The
+// pings are limited by the init timeout and the tenants, which are reconnected,
+// are skipped by the collection, so that a hung tenant delays neither the
+// others nor the scrape.
+func (config *Config) ReviveTenants(parent context.Context, filter ScrapeFilter) {
+
+	if config.ConnectFunc == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
 	for tPos := range config.Tenants {
 
-		go func(tPos int) {
+		if !filter.selects(&config.Tenants[tPos]) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(tPos int) {
+			defer wg.Done()
+
+			tenant := &config.Tenants[tPos]
+			config.connMu.RLock()
+			conn, state := tenant.conn, tenant.state
+			config.connMu.RUnlock()
+			if state == tenantConnected && conn != nil {
+				ctx, cancel := config.InitContext(parent)
+				err := conn.PingContext(ctx)
+				cancel()
+				if err == nil {
+					return
+				}
+				log.WithFields(log.Fields{
+					"tenant": tenant.Name,
+					"error":  err,
+				}).Warn("Lost connection to tenant - trying to reconnect.")
+			}
+
+			config.reviveTenant(tPos)
+		}(tPos)
+	}
+	wg.Wait()
+}
+
+// ExporterMetrics - metrics about the exporter itself
+func (config *Config) ExporterMetrics() []MetricData {
+	config.guard.Lock()
+	defer config.guard.Unlock()
+
+	up := MetricData{
+		Name:       "hana_sql_exporter_tenant_up",
+		Help:       "Connection state of the tenant (1 = connected, 0 = down).",
+		MetricType: "gauge",
+	}
+
+	// a drop of the discovered schemas signals a privilege problem
+	schemas := MetricData{
+		Name:       "hana_sql_exporter_tenant_schemas",
+		Help:       "Number of schemas discovered for the tenant user.",
+		MetricType: "gauge",
+	}
+	config.connMu.RLock()
+	for _, tenant := range config.Tenants {
+		var value float64
+		if tenant.state == tenantConnected {
+			value = 1
+			schemas.Stats = append(schemas.Stats, MetricRecord{
+				Value:       float64(len(tenant.Schemas)),
+				Labels:      []string{"tenant"},
+				LabelValues: []string{low(tenant.Name)},
+			})
+		}
+		up.Stats = append(up.Stats, MetricRecord{
+			Value:       value,
+			Labels:      []string{"tenant"},
+			LabelValues: []string{low(tenant.Name)},
+		})
+	}
+	config.connMu.RUnlock()
+
+	return []MetricData{
+		up,
+		{
+			Name:       "hana_sql_exporter_config_hash",
+			Help:       "Hash of the loaded configuration without secrets.",
+			MetricType: "gauge",
+			Stats: []MetricRecord{
+				{
+					Value:       1,
+					Labels:      []string{"hash"},
+					LabelValues: []string{config.hash},
+				},
+			},
+		},
+		schemas,
+		config.LastErrorMetrics(),
+		config.UnavailableMetrics(),
+		config.TenantInfoMetrics(),
+		config.cacheAgeMetrics(),
+		config.HanaUpMetrics(),
+		config.ScrapeDurationMetrics(),
+		config.ErrorCountMetrics(),
+		config.GoroutineMetrics(),
+	}
+}
+
+// GoroutineMetrics - number of running collection goroutines of the metrics
+// and tenants, which should return to zero after every scrape
+func (config *Config) GoroutineMetrics() MetricData {
+	return MetricData{
+		Name:       "hana_sql_exporter_active_collection_goroutines",
+		Help:       "Number of running goroutines, which collect a metric of a tenant.",
+		MetricType: "gauge",
+		Stats: []MetricRecord{
+			{Value: float64(atomic.LoadInt32(&config.goroutines))},
+		},
+	}
+}
+
+// keep the duration of the query and scan of the metric for the tenant
+func (config *Config) recordDuration(mPos, tPos int, d time.Duration) {
+	config.durMu.Lock()
+	defer config.durMu.Unlock()
+
+	if config.durations == nil {
+		config.durations = make(map[[2]string]float64)
+	}
+	config.durations[[2]string{config.Metrics[mPos].Name, low(config.Tenants[tPos].Name)}] = d.Seconds()
+}
+
+// ScrapeDurationMetrics - duration of the last query and scan per metric and tenant
+func (config *Config) ScrapeDurationMetrics() MetricData {
+	config.durMu.Lock()
+	defer config.durMu.Unlock()
+
+	md := MetricData{
+		Name:       "hana_scrape_duration_seconds",
+		Help:       "Duration of the last query including reading the result of the metric and tenant.",
+		MetricType: "gauge",
+	}
+	for key, d := range config.durations {
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       d,
+			Labels:      []string{"metric", "tenant"},
+			LabelValues: []string{key[0], key[1]},
+		})
+	}
+	return md
+}
+
+// HanaUpMetrics - availability of the tenants: 1, if the tenant is connected
+// and none of its queries failed during the last complete collection
+func (config *Config) HanaUpMetrics() MetricData {
+	config.errMu.Lock()
+	defer config.errMu.Unlock()
+
+	failed := make(map[string]bool)
+	for key, t := range config.lastErrors {
+		if !t.Before(config.collectStart) {
+			failed[key[1]] = true
+		}
+	}
+
+	md := MetricData{
+		Name:       "hana_up",
+		Help:       "Availability of the tenant in the last collection (1 = connected and all queries succeeded, 0 = connection or query failed).",
+		MetricType: "gauge",
+	}
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+	for _, tenant := range config.Tenants {
+		var value float64
+		if tenant.state == tenantConnected && !failed[low(tenant.Name)] {
+			value = 1
+		}
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       value,
+			Labels:      []string{"tenant", "usage"},
+			LabelValues: []string{low(tenant.Name), low(tenant.Usage)},
+		})
+	}
+	return md
+}
+
+// age of the result of the last guarded collection per metric and tenant,
+// which is served until the minimum interval has passed - the guard must be
+// held by the caller
+func (config *Config) cacheAgeMetrics() MetricData {
+	md := MetricData{
+		Name:       "hana_sql_exporter_cache_age_seconds",
+		Help:       "Age of the collected values served for the metric and tenant within the minimum interval.",
+		MetricType: "gauge",
+	}
+	if config.MinInterval == 0 || config.collected.IsZero() {
+		return md
+	}
+
+	age := time.Since(config.collected).Seconds()
+	seen := make(map[[2]string]bool)
+	for _, metric := range config.lastMetrics {
+		for _, record := range metric.Stats {
+			key := [2]string{metric.Name, record.Tenant}
+			if "" == record.Tenant || seen[key] {
+				continue
+			}
+			seen[key] = true
+			md.Stats = append(md.Stats, MetricRecord{
+				Value:       age,
+				Labels:      []string{"metric", "tenant"},
+				LabelValues: []string{key[0], key[1]},
+			})
+		}
+	}
+	return md
+}
+
+// TenantInfoMetrics - inventory of the prepared tenants without credentials
+func (config *Config) TenantInfoMetrics() MetricData {
+	md := MetricData{
+		Name:       "hana_sql_exporter_tenant_info",
+		Help:       "Configured tenant with usage, host and joined tags.",
+		MetricType: "gauge",
+	}
+	config.connMu.RLock()
+	defer config.connMu.RUnlock()
+	for _, tenant := range config.Tenants {
+		host := tenant.ActiveHost()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       1,
+			Labels:      []string{"tenant", "usage", "host", "tags"},
+			LabelValues: []string{low(tenant.Name), low(tenant.Usage), low(host), low(strings.Join(tenant.Tags, ","))},
+		})
+	}
+	return md
+}
+
+// ConfigHash - stable hash of the tenant and metric definitions
+func (config *Config) ConfigHash() (string, error) {
+	b, err := json.Marshal(struct {
+		Tenants []TenantInfo
+		Metrics []MetricInfo
+	}{
+		config.Tenants,
+		config.Metrics,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "ConfigHash(Marshal)")
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CollectMetrics - collecting all metrics and fetch the results. The exporter
+// is ready after the first complete collection with data.
+func (config *Config) CollectMetrics() []MetricData {
+	config.errMu.Lock()
+	config.collectStart = time.Now()
+	config.errMu.Unlock()
+
+	md := config.CollectFilteredMetrics(ScrapeFilter{Deadline: config.requestTimeout()})
+	if len(md) > 0 && md[len(md)-1].Name != scrapePartialName && md[len(md)-1].Name != scrapeStalledName {
+		config.readyMu.Lock()
+		config.ready = true
+		config.readyMu.Unlock()
+	}
+	return md
+}
+
+// CollectFilteredMetrics - collecting the metrics of the filter and fetch the
+// results. A collection, which hangs far beyond its timeout, e.g. because of a
+// deadlock, is cancelled by the watchdog with a stack dump in the log and the
+// marker metric hana_sql_exporter_scrape_stalled as result. Until the
+// cancelled collection has returned, further collections get the marker, so
+// that they never run alongside it.
+func (config *Config) CollectFilteredMetrics(filter ScrapeFilter) []MetricData {
+
+	if config.WatchdogTimeout <= 0 {
+		return config.collectFiltered(context.Background(), filter)
+	}
+	if config.Stalled() {
+		return stalledMetrics()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	limit := config.WatchdogLimit(filter)
+	resC := make(chan []MetricData, 1)
+	go func() {
+		resC <- config.collectFiltered(ctx, filter)
+	}()
+
+	select {
+	case md := <-resC:
+		cancel()
+		return md
+	case <-time.After(limit):
+		stack := make([]byte, 1<<20)
+		stack = stack[:runtime.Stack(stack, true)]
+		log.WithFields(log.Fields{
+			"limit": limit,
+			"stack": string(stack),
+		}).Error("Collection stalled - cancelled by the watchdog.")
+
+		config.setStalled(true)
+		cancel()
+		go func() {
+			<-resC
+			config.setStalled(false)
+		}()
+		return stalledMetrics()
+	}
+}
+
+// Stalled - true, while a collection cancelled by the watchdog hasn't returned
+func (config *Config) Stalled() bool {
+	config.stallMu.Lock()
+	defer config.stallMu.Unlock()
+
+	return config.stalled
+}
+
+func (config *Config) setStalled(stalled bool) {
+	config.stallMu.Lock()
+	config.stalled = stalled
+	config.stallMu.Unlock()
+}
+
+// marker of a stalled collection
+func stalledMetrics() []MetricData {
+	return []MetricData{
+		{
+			Name:       scrapeStalledName,
+			Help:       "The collection exceeded the watchdog limit and was cancelled.",
+			MetricType: "gauge",
+			Stats:      []MetricRecord{{Value: 1}},
+		},
+	}
+}
+
+// WatchdogLimit - hard limit of a collection, at least twice the scrape
+// timeout of the filter
+func (config *Config) WatchdogLimit(filter ScrapeFilter) time.Duration {
+	limit := time.Duration(config.WatchdogTimeout * float64(time.Second))
+	if min := 2 * config.FilterTimeout(filter); limit < min {
+		return min
+	}
+	return limit
+}
+
+// collecting the metrics of the filter, until the parent context is cancelled
+func (config *Config) collectFiltered(parent context.Context, filter ScrapeFilter) []MetricData {
+
+	// hard ceiling of the whole collection
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	if config.MaxScrapeDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.MaxScrapeDuration*float64(time.Second)))
+		defer cancel()
+	}
+
+	// parameters bound by the metrics of this collection
+	config.setParams(filter.Params)
+
+	// use or revive the tenant connections
+	config.ReviveTenants(ctx, filter)
+
+	var wg sync.WaitGroup
+	metricCnt := len(config.Metrics)
+	metricsC := make(chan MetricData, metricCnt)
+
+	for mPos := range config.Metrics {
+
+		if len(filter.Metrics) > 0 && !ContainsString(config.Metrics[mPos].Name, filter.Metrics) {
+			continue
+		}
+
+		// the send respects the context, so that a reader, which returned
+		// with a partial result, doesn't strand the sender
+		wg.Add(1)
+		config.metricRuns.Add(1)
+		go func(mPos int) {
+
+			defer config.metricRuns.Done()
+			defer wg.Done()
+			md := MetricData{
+				Name:        config.Metrics[mPos].Name,
+				Help:        config.Metrics[mPos].Help,
+				MetricType:  config.Metrics[mPos].MetricType,
+				SampleLimit: config.Metrics[mPos].SampleLimit,
+				Stats:       config.CollectMetric(ctx, mPos, filter),
+			}
+			select {
+			case metricsC <- md:
+			case <-ctx.Done():
+			}
+		}(mPos)
+	}
+
+	go func() {
+		wg.Wait()
+		close(metricsC)
+	}()
+
+	// the metrics collected so far with a marker
+	partial := func(metricsData []MetricData) []MetricData {
+		log.WithFields(log.Fields{
+			"metrics": len(metricsData),
+		}).Warn("Maximum scrape duration exceeded - partial result returned.")
+		return append(metricsData, MetricData{
+			Name:       scrapePartialName,
+			Help:       "The scrape exceeded the maximum scrape duration and returned partial results.",
+			MetricType: "gauge",
+			Stats:      []MetricRecord{{Value: 1}},
+		})
+	}
+
+	var metricsData []MetricData
+	for {
+		select {
+		case metric, ok := <-metricsC:
+
+			// the senders, which gave up at the deadline, close the channel
+			// as well, so the result is only complete before the deadline
+			if !ok {
+				if ctx.Err() != nil {
+					return partial(metricsData)
+				}
+				return metricsData
+			}
+			if metric.Stats != nil {
+				metricsData = append(metricsData, metric)
+			}
+		case <-ctx.Done():
+			return partial(metricsData)
+		}
+	}
+}
+
+// CollectMetric - collecting one metric for every tenants of the filter
+func (config *Config) CollectMetric(parent context.Context, mPos int, filter ScrapeFilter) []MetricRecord {
+
+	// set timeout
+	ctx, cancel := context.WithTimeout(parent, config.FilterTimeout(filter))
+	defer cancel()
+
+	tenantCnt := 0
+	metricC := make(chan []MetricRecord, len(config.Tenants))
+
+	// optional limit of the tenants queried in parallel
+	var sem chan struct{}
+	if config.TenantConcurrency > 0 {
+		sem = make(chan struct{}, config.TenantConcurrency)
+	}
+
+	// landscape-global metrics are only collected for one tenant
+	gPos := -1
+	if config.Metrics[mPos].Global {
+		gPos = config.GlobalTenant(mPos, filter)
+	}
+
+	for tPos := range config.Tenants {
+
+		// tenants, which are down, are skipped until they are revived
+		if config.stateOf(tPos) != tenantConnected {
+			continue
+		}
+
+		if !filter.selects(&config.Tenants[tPos]) {
+			continue
+		}
+		if config.Metrics[mPos].Global && tPos != gPos {
+			continue
+		}
+		tenantCnt++
+
+		// the queries are cancelled with the context and the result of a
+		// timed out tenant is dropped, so that no goroutine outlives the scrape
+		atomic.AddInt32(&config.goroutines, 1)
+		go func(tPos int) {
+			defer atomic.AddInt32(&config.goroutines, -1)
+
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return
+				}
+			}
+			if slots := config.slots(); slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case metricC <- config.DataFunc(ctx, mPos, tPos):
+			case <-ctx.Done():
+			}
+		}(tPos)
+	}
+
+	// collect data
+	var sData []MetricRecord
+	for i := 0; i < tenantCnt; i++ {
+		select {
+		case mc := <-metricC:
+			if mc != nil {
+				sData = append(sData, mc...)
+			}
+		case <-ctx.Done():
+			config.RecordError(config.Metrics[mPos].Name, "", errors.Errorf("scrape timeout - %d tenant(s) did not answer", tenantCnt-i))
+			config.CountError(config.Metrics[mPos].Name, "", "timeout")
+			return sData
+		}
+	}
+	return sData
+}
+
+// global limit of the queries running at the same time, nil without limit.
+// Queries beyond the limit wait for a free slot until their scrape timeout.
+func (config *Config) slots() chan struct{} {
+	config.slotsOnce.Do(func() {
+		if config.QueryConcurrency > 0 {
+			config.querySlots = make(chan struct{}, config.QueryConcurrency)
+		}
+	})
+	return config.querySlots
+}
+
+// GlobalTenant - tenant, which collects the landscape-global metric for all
+// tenants: the designated GlobalTenant or, if it isn't available, the first
+// connected tenant of the filter. -1, if there is none.
+func (config *Config) GlobalTenant(mPos int, filter ScrapeFilter) int {
+	gPos := -1
+	for tPos := range config.Tenants {
+		if config.stateOf(tPos) != tenantConnected || !filter.selects(&config.Tenants[tPos]) {
+			continue
+		}
+		if strings.EqualFold(config.Tenants[tPos].Name, config.Metrics[mPos].GlobalTenant) {
+			return tPos
+		}
+		if gPos < 0 {
+			gPos = tPos
+		}
+	}
+	return gPos
+}
+
+// ScrapeTimeout - timeout of the collection, reduced by the buffer for
+// serializing and transmitting the response
+func (config *Config) ScrapeTimeout() time.Duration {
+	return config.bufferedTimeout(time.Duration(config.Timeout) * time.Second)
+}
+
+// FilterTimeout - scrape timeout of the filter, if it has its own timeout
+func (config *Config) FilterTimeout(filter ScrapeFilter) time.Duration {
+	if filter.Deadline > 0 {
+		return config.bufferedTimeout(filter.Deadline)
+	}
+	if filter.Timeout > 0 {
+		return config.bufferedTimeout(time.Duration(filter.Timeout) * time.Second)
+	}
+	return config.ScrapeTimeout()
+}
+
+// HeaderTimeout - scrape timeout of prometheus from the request header
+// X-Prometheus-Scrape-Timeout-Seconds, limited by the write budget of the
+// server. 0, if the header is missing or malformed.
+func (config *Config) HeaderTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if "" == header {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(header), 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		log.WithFields(log.Fields{
+			"header": header,
+		}).Debug("Malformed scrape timeout header - timeout flag is used.")
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if config.writeBudget > 0 && timeout > config.writeBudget {
+		return config.writeBudget
+	}
+	return timeout
+}
+
+// scrape timeout of the last request to the cached metrics
+func (config *Config) setRequestTimeout(timeout time.Duration) {
+	config.timeoutMu.Lock()
+	config.reqTimeout = timeout
+	config.timeoutMu.Unlock()
+}
+
+func (config *Config) requestTimeout() time.Duration {
+	config.timeoutMu.Lock()
+	defer config.timeoutMu.Unlock()
+	return config.reqTimeout
+}
+
+// timeout reduced by the timeout buffer
+func (config *Config) bufferedTimeout(timeout time.Duration) time.Duration {
+	buffer := time.Duration(config.TimeoutBuffer * float64(time.Second))
+
+	// a buffer that consumes the whole timeout is ignored
+	if buffer <= 0 || buffer >= timeout {
+		return timeout
+	}
+	return timeout - buffer
+}
+
+// GetMetricData - metric data for one tenant
+func (config *Config) GetMetricData(ctx context.Context, mPos, tPos int) []MetricRecord {
+
+	// tenants excluded by the filters get the sentinel value, if the metric has one
+	if nil != config.Metrics[mPos].FilteredValue && !config.MetricApplies(mPos, tPos) {
+		return config.FilteredRecords(mPos, tPos)
+	}
+
+	sel := config.GetSelection(mPos, tPos)
+	if "" == sel {
+		return nil
+	}
+
+	// metrics with parameters are only collected by scrapes supplying them
+	args, ok := config.MetricArgs(mPos)
+	if !ok {
+		return nil
+	}
+
+	// metrics for the system db are skipped for tenants without system db connection
+	db := config.connection(tPos, &config.Metrics[mPos])
+	if db == nil {
+		return nil
+	}
+
+	// metrics referencing objects, which don't exist on the tenant, are skipped
+	if config.MetricUnavailable(mPos, tPos) {
+		return nil
+	}
+
+	// the own timeout of the metric bounds its queries within the scrape
+	// timeout, so that a slow metric doesn't consume the whole scrape
+	scrapeCtx := ctx
+	if config.Metrics[mPos].Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Metrics[mPos].Timeout*float64(time.Second)))
+		defer cancel()
+	}
+	timedOut := func() bool {
+		return ctx.Err() != nil && scrapeCtx.Err() == nil
+	}
+
+	// skip the metric, if the precondition of the gating query is not fulfilled
+	if "" != config.Metrics[mPos].GateSQL {
+		open, err := GateOpen(ctx, db, config.CommentQuery(mPos, tPos, config.GetGateSelection(mPos, tPos)))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"metric": config.Metrics[mPos].Name,
+				"tenant": config.Tenants[tPos].Name,
+				"error":  err,
+			}).Error("Can't get result of gating query for metric")
+			config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+			config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "gate")
+			return nil
+		}
+		if !open {
+			return nil
+		}
+	}
+
+	// heavy metrics run on a dedicated connection with a statement memory limit
+	limitFailed := false
+	query := func(db *sql.DB) (*sql.Rows, func(), error) {
+		var q interface {
+			QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		} = db
+		release := func() {}
+		if "" != config.Metrics[mPos].MemoryLimit {
+			conn, done, err := MemoryLimitConn(ctx, db, config.Metrics[mPos].MemoryLimit)
+			if err != nil {
+				limitFailed = true
+				return nil, release, err
+			}
+			q, release = conn, done
+		}
+		rows, err := q.QueryContext(ctx, config.CommentQuery(mPos, tPos, sel), args...)
+		if err != nil {
+			release()
+			return nil, func() {}, err
+		}
+		return rows, release, nil
+	}
+
+	log.WithFields(log.Fields{
+		"metric": config.Metrics[mPos].Name,
+		"tenant": config.Tenants[tPos].Name,
+		"sql":    sel,
+	}).Debug("Querying metric.")
+
+	// a dropped connection is reopened and the query is retried once
+	start := time.Now()
+	rows, release, err := query(db)
+	if err != nil && ConnectionError(err) {
+		if db = config.ReopenConnection(ctx, mPos, tPos, db); db != nil {
+			limitFailed = false
+			start = time.Now()
+			rows, release, err = query(db)
+		}
+	}
+	if err != nil && limitFailed {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Error("Can't set statement memory limit for metric")
+		config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "memory_limit")
+		return nil
+	}
+	if err != nil && ObjectNotFound(err) {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Warn("Object of metric not found - metric disabled for tenant until the next recheck")
+		config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "object_not_found")
+		config.markUnavailable(mPos, tPos)
+		return nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Error("Can't get sql result for metric")
+		config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+		reason := "query"
+		if timedOut() {
+			reason = "metric_timeout"
+		}
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, reason)
+		return nil
+	}
+	defer release()
+	defer rows.Close()
+
+	var md []MetricRecord
+	tenant := config.tenantOf(tPos)
+	if "summary" == low(config.Metrics[mPos].MetricType) {
+		md, err = tenant.GetSummaryRows(rows)
+	} else {
+		md, err = tenant.GetMetricRows(rows, &config.Metrics[mPos])
+	}
+	config.recordDuration(mPos, tPos, time.Since(start))
+	// if err = rows.Err(); err != nil {
+	if err != nil {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Error("Can't read sql result for metric")
+		config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+		reason := ReadErrorReason(err)
+		if timedOut() {
+			reason = "metric_timeout"
+		}
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, reason)
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"metric":  config.Metrics[mPos].Name,
+		"tenant":  config.Tenants[tPos].Name,
+		"sql":     sel,
+		"records": len(md),
+	}).Debug("Result of metric read.")
+
+	if "histogram" == low(config.Metrics[mPos].MetricType) {
+		md, err = HistogramRecords(md, config.Tenants[tPos].DecimalSeparator)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"metric": config.Metrics[mPos].Name,
+				"tenant": config.Tenants[tPos].Name,
+				"error":  err,
+			}).Error("Malformed histogram result of metric")
+			config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+			config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "histogram")
+			return nil
+		}
+	}
+	if "" != config.Metrics[mPos].NegativeValues {
+		md = config.CheckNegativeValues(mPos, tPos, md)
+	}
+	if "" != config.Metrics[mPos].InvalidValues {
+		md = config.CheckInvalidValues(mPos, tPos, md)
+	}
+	if "counter" == low(config.Metrics[mPos].MetricType) {
+		md = config.CheckCounterValues(mPos, tPos, md)
+	}
+	if config.TagsLabel {
+		md = config.AddTagsLabel(tPos, md)
+	}
+	return config.MaskTenant(mPos, config.AddOrigin(mPos, tPos, config.AddPrefix(tPos, md)))
+}
+
+// AddPrefix - set the metric name prefix of the tenant
+func (config *Config) AddPrefix(tPos int, md []MetricRecord) []MetricRecord {
+	prefix := config.MetricPrefix(tPos)
+	for i := range md {
+		md[i].Prefix = prefix
+	}
+	return md
+}
+
+// AddOrigin - set tenant and schema of the records for the help template
+func (config *Config) AddOrigin(mPos, tPos int, md []MetricRecord) []MetricRecord {
+	schema := FirstValueInSlice(config.Metrics[mPos].SchemaFilter, config.schemasOf(tPos))
+	for i := range md {
+		md[i].Tenant = low(config.Tenants[tPos].Name)
+		md[i].Schema = low(schema)
+	}
+	return md
+}
+
+// MaskTenant - replace the tenant of the records of metrics, which are shared
+// externally, by the alias of the tenant or, without alias, by a keyed hash of
+// its name, so that internal tenant names are not revealed
+func (config *Config) MaskTenant(mPos int, md []MetricRecord) []MetricRecord {
+	if !config.Metrics[mPos].MaskTenant {
+		return md
+	}
+	for i := range md {
+		for j, label := range md[i].Labels {
+			if "tenant" == label {
+				md[i].LabelValues[j] = config.TenantMask(md[i].LabelValues[j])
+			}
+		}
+		md[i].Tenant = config.TenantMask(md[i].Tenant)
+	}
+	return md
+}
+
+// TenantMask - opaque alias of the tenant: its Alias or the first 12 hex
+// digits of the hmac of its name with the mask key. Short tenant names, e.g.
+// SIDs, can't be guessed from it without the key.
+func (config *Config) TenantMask(name string) string {
+	for _, tenant := range config.Tenants {
+		if strings.EqualFold(tenant.Name, name) && "" != tenant.Alias {
+			return low(tenant.Alias)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(config.MaskKey))
+	mac.Write([]byte(low(name)))
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// MetricPrefix - metric name prefix of the tenant: its alias or, if all
+// tenants should be prefixed, its name
+func (config *Config) MetricPrefix(tPos int) string {
+	if "" != config.Tenants[tPos].MetricPrefix {
+		return config.Tenants[tPos].MetricPrefix
+	}
+	if config.TenantPrefix {
+		return low(config.Tenants[tPos].Name)
+	}
+	return ""
+}
+
+// CommentQuery - prepend a comment with metric and tenant, so that the query
+// can be traced in the sql plan cache, if query comments are enabled
+func (config *Config) CommentQuery(mPos, tPos int, sel string) string {
+	if !config.QueryComment {
+		return sel
+	}
+
+	// the names must not end the comment
+	clean := strings.NewReplacer("*/", "", "/*", "")
+	return fmt.Sprintf("/* hana_sql_exporter metric=%s tenant=%s */ %s",
+		clean.Replace(config.Metrics[mPos].Name),
+		clean.Replace(low(config.Tenants[tPos].Name)),
+		sel)
+}
+
+// hana error codes of objects, which don't exist: invalid table name, invalid
+// column name, invalid schema name and invalid object name
+var objectNotFoundCodes = []int{259, 260, 362, 397}
+
+// ConnectionError - true, if the error means a dropped connection, e.g. after
+// a restart of hana, so that the tenant has to be reconnected
+func ConnectionError(err error) bool {
+
+	// timed out or cancelled queries leave the connection intact
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := low(err.Error())
+	for _, s := range []string{"database is closed", "connection refused", "connection reset", "broken pipe"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectNotFound - true, if the error is caused by a missing table, view,
+// column or schema
+func ObjectNotFound(err error) bool {
+	var dbErr interface{ Code() int }
+	if errors.As(err, &dbErr) {
+		for _, code := range objectNotFoundCodes {
+			if dbErr.Code() == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	// other drivers
+	msg := low(err.Error())
+	return strings.Contains(msg, "invalid table name") || strings.Contains(msg, "could not find table/view")
+}
+
+// MetricUnavailable - true, if the metric has been marked as unavailable for
+// the tenant and the recheck interval has not yet passed
+func (config *Config) MetricUnavailable(mPos, tPos int) bool {
+	config.unavailMu.Lock()
+	defer config.unavailMu.Unlock()
+
+	key := [2]string{config.Metrics[mPos].Name, low(config.Tenants[tPos].Name)}
+	marked, ok := config.unavailable[key]
+	if !ok {
+		return false
+	}
+	if config.RecheckInterval > 0 && time.Since(marked) >= time.Duration(config.RecheckInterval)*time.Second {
+		delete(config.unavailable, key)
+		return false
+	}
+	return true
+}
+
+// mark the metric as unavailable for the tenant
+func (config *Config) markUnavailable(mPos, tPos int) {
+	config.unavailMu.Lock()
+	defer config.unavailMu.Unlock()
+
+	if config.unavailable == nil {
+		config.unavailable = make(map[[2]string]time.Time)
+	}
+	config.unavailable[[2]string{config.Metrics[mPos].Name, low(config.Tenants[tPos].Name)}] = time.Now()
+}
+
+// UnavailableMetrics - metrics marked as unavailable per tenant
+func (config *Config) UnavailableMetrics() MetricData {
+	config.unavailMu.Lock()
+	defer config.unavailMu.Unlock()
+
+	md := MetricData{
+		Name:       "hana_sql_exporter_metric_unavailable",
+		Help:       "The metric is skipped for the tenant, because it references objects, which don't exist.",
+		MetricType: "gauge",
+	}
+	for key := range config.unavailable {
+		md.Stats = append(md.Stats, MetricRecord{
+			Value:       1,
+			Labels:      []string{"metric", "tenant"},
+			LabelValues: []string{key[0], key[1]},
+		})
+	}
+	return md
+}
+
+// MetricApplies - true, if the tag and schema filter of the metric match the tenant
+func (config *Config) MetricApplies(mPos, tPos int) bool {
+	if !SubSliceInSlice(config.Metrics[mPos].TagFilter, config.Tenants[tPos].Tags) {
+		return false
+	}
+	return "" != FirstValueInSlice(config.Metrics[mPos].SchemaFilter, config.schemasOf(tPos))
+}
+
+// FilteredRecords - record with the sentinel value of the metric for a tenant
+// excluded by the filters
+func (config *Config) FilteredRecords(mPos, tPos int) []MetricRecord {
+	tenant := config.tenantOf(tPos)
+	md := []MetricRecord{
+		{
+			Value:       *config.Metrics[mPos].FilteredValue,
+			Labels:      []string{"tenant", "usage"},
+			LabelValues: []string{low(tenant.Name), low(tenant.Usage)},
+		},
+	}
+	if config.TagsLabel {
+		md = config.AddTagsLabel(tPos, md)
+	}
+	return config.MaskTenant(mPos, config.AddOrigin(mPos, tPos, config.AddPrefix(tPos, md)))
+}
+
+// CheckCounterValues - handle fractional values of counters, which point to a
+// gauge typed as counter: "warn" (default) logs them, "round" rounds them to
+// integers and "accept" keeps them silently
+func (config *Config) CheckCounterValues(mPos, tPos int, md []MetricRecord) []MetricRecord {
+
+	handling := low(config.Metrics[mPos].CounterFraction)
+	if "accept" == handling {
+		return md
+	}
+
+	for i := range md {
+		if md[i].Value == math.Trunc(md[i].Value) {
+			continue
+		}
+		if "round" == handling {
+			md[i].Value = math.Round(md[i].Value)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"value":  md[i].Value,
+		}).Warn("Counter has a fractional value - perhaps it should be a gauge.")
+	}
+	return md
+}
+
+// CheckInvalidValues - handle values, which are NaN, infinite or exceed the
+// value limit of the metric: "keep" (default) emits them unchanged, "drop"
+// skips their records and "cap" sets them to the limit, NaN is always
+// dropped. Every affected result is logged and recorded as error.
+func (config *Config) CheckInvalidValues(mPos, tPos int, md []MetricRecord) []MetricRecord {
+
+	handling := low(config.Metrics[mPos].InvalidValues)
+	if "" == handling || "keep" == handling {
+		return md
+	}
+	limit := config.Metrics[mPos].ValueLimit
+	if limit <= 0 {
+		limit = math.MaxFloat64
+	}
+
+	var res []MetricRecord
+	var invalid int
+	for _, record := range md {
+		if nil != record.Histogram || nil != record.Summary || math.Abs(record.Value) <= limit {
+			res = append(res, record)
+			continue
+		}
+		invalid++
+		if "cap" == handling && !math.IsNaN(record.Value) {
+			record.Value = math.Copysign(limit, record.Value)
+			res = append(res, record)
+		}
+	}
+	if invalid == 0 {
+		return md
+	}
+
+	err := errors.Errorf("%d invalid value(s) handled with %s", invalid, handling)
+	log.WithFields(log.Fields{
+		"metric": config.Metrics[mPos].Name,
+		"tenant": config.Tenants[tPos].Name,
+		"error":  err,
+	}).Warn("Metric has NaN, infinite or too large values.")
+	config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, err)
+	config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "invalid_value")
+	return res
+}
+
+// CheckNegativeValues - handle negative values, e.g. of deltas, which wrapped
+// around: "keep" (default) emits them unchanged, "abs" takes the absolute
+// value, "zero" clamps them to 0 and "drop" skips their records.
+func (config *Config) CheckNegativeValues(mPos, tPos int, md []MetricRecord) []MetricRecord {
+
+	handling := low(config.Metrics[mPos].NegativeValues)
+	if "" == handling || "keep" == handling {
+		return md
+	}
+
+	var res []MetricRecord
+	var negative int
+	for _, record := range md {
+		if nil != record.Histogram || nil != record.Summary || !(record.Value < 0) {
+			res = append(res, record)
+			continue
+		}
+		negative++
+		switch handling {
+		case "abs":
+			record.Value = math.Abs(record.Value)
+		case "zero":
+			record.Value = 0
+		default:
+			continue
+		}
+		res = append(res, record)
+	}
+	if negative > 0 {
+		log.WithFields(log.Fields{
+			"metric":   config.Metrics[mPos].Name,
+			"tenant":   config.Tenants[tPos].Name,
+			"negative": negative,
+			"handling": handling,
+		}).Debug("Negative values of metric handled.")
+	}
+	return res
+}
+
+// AddTagsLabel - add the joined tenant tags as label to the metric records
+func (config *Config) AddTagsLabel(tPos int, md []MetricRecord) []MetricRecord {
+
+	// the length of the tags is checked by ValidateMetrics, so that all
+	// records of a metric have the label
+	tags := low(strings.Join(config.Tenants[tPos].Tags, ","))
+	for i := range md {
+		md[i].Labels = append(md[i].Labels, "tags")
+		md[i].LabelValues = append(md[i].LabelValues, tags)
+	}
+	return md
+}
+
+// GetSelection - prepare the db selection
+func (config *Config) GetSelection(mPos, tPos int) string {
+
+	// all values of metrics tag filter must be in tenants tags, otherwise the
+	// metric is not relevant for the tenant
+	if !SubSliceInSlice(config.Metrics[mPos].TagFilter, config.Tenants[tPos].Tags) {
+		return ""
+	}
+
+	sel := strings.TrimSpace(config.MetricSQL(mPos, tPos))
+	if !IsSelect(sel) && !IsProcedureCall(sel) {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+		}).Error("Only selects and calls of allowed procedures are allowed")
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "invalid_select")
+		return ""
+	}
+
+	// metrics schema filter must include a tenant schema
+	var schema string
+	if schema = FirstValueInSlice(config.Metrics[mPos].SchemaFilter, config.schemasOf(tPos)); 0 == len(schema) {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+		}).Error("metrics schema filter must include a tenant schema")
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "schema_filter")
+		return ""
+	}
+
+	// the resolved schema must be allowed, independent of the metric definition
+	if len(config.AllowedSchemas) > 0 && !ContainsString(schema, config.AllowedSchemas) {
+		log.WithFields(log.Fields{
+			"metric": config.Metrics[mPos].Name,
+			"tenant": config.Tenants[tPos].Name,
+			"schema": schema,
+		}).Error("Schema of metric is not allowed")
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "schema_not_allowed")
+		return ""
+	}
+	sel = strings.ReplaceAll(sel, "<SCHEMA>", schema)
+
+	// procedures are only called, if they are explicitly allowed
+	if IsProcedureCall(sel) && !config.procedureAllowed(sel) {
+		log.WithFields(log.Fields{
+			"metric":    config.Metrics[mPos].Name,
+			"tenant":    config.Tenants[tPos].Name,
+			"procedure": ProcedureName(sel),
+		}).Error("Procedure of metric is not allowed")
+		config.CountError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, "procedure_not_allowed")
+		return ""
+	}
+	return sel
+}
+
+// IsSelect - true, if the statement is a select or a select with common table
+// expressions, which must not contain modifying statements. Leading comments
+// are ignored.
+func IsSelect(sel string) bool {
+	sel = StripComments(sel)
+	if len(sel) >= 6 && strings.EqualFold(sel[0:6], "select") {
+		return true
+	}
+	return len(sel) > 4 && strings.EqualFold(sel[0:4], "with") && unicode.IsSpace(rune(sel[4])) && !modifyingRE.MatchString(sel)
+}
+
+// StripComments - statement without leading whitespace and comments
+func StripComments(sel string) string {
+	sel = strings.TrimSpace(sel)
+	for loc := leadingCommentRE.FindStringIndex(sel); loc != nil; loc = leadingCommentRE.FindStringIndex(sel) {
+		sel = strings.TrimSpace(sel[loc[1]:])
+	}
+	return sel
+}
+
+// IsProcedureCall - true, if the statement is a single procedure call
+func IsProcedureCall(sel string) bool {
+	return procedureCallRE.MatchString(strings.TrimSuffix(StripComments(sel), ";"))
+}
+
+// ProcedureName - normalised name of the called procedure with quoted schema
+// and name, e.g. "MONITORING"."GET_ALERTS"
+func ProcedureName(sel string) string {
+	m := procedureCallRE.FindStringSubmatch(strings.TrimSuffix(StripComments(sel), ";"))
+	if m == nil {
+		return ""
+	}
+	return quotedIdentifier(m[1])
+}
+
+// quotedIdentifier - dotted identifier with quoted parts as compared by hana
+// or "", if it is malformed. The quotes keep schema and name apart.
+func quotedIdentifier(name string) string {
+	parts := identifierParts(name)
+	for i := range parts {
+		parts[i] = `"` + parts[i] + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// identifierParts - parts of a dotted identifier as compared by hana: unquoted
+// parts in upper case, quoted parts verbatim, nil if it is malformed
+func identifierParts(name string) []string {
+	var parts []string
+	for rest := strings.TrimSpace(name); ; {
+		var part string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 1 {
+				return nil
+			}
+			part, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.Index(rest, ".")
+			if end < 0 {
+				end = len(rest)
+			}
+			part, rest = strings.ToUpper(rest[:end]), rest[end:]
+			if "" == part {
+				return nil
+			}
+		}
+		parts = append(parts, part)
+		if "" == rest {
+			return parts
+		}
+		if !strings.HasPrefix(rest, ".") {
+			return nil
+		}
+		rest = rest[1:]
+	}
+}
+
+// true, if the schema and name of the called procedure match one of the
+// allowed procedures
+func (config *Config) procedureAllowed(sel string) bool {
+	name := ProcedureName(sel)
+	for _, allowed := range config.AllowedProcedures {
+		if "" != name && quotedIdentifier(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricSQL - sql of the metric for the tenant: the override of the tenant,
+// if there is one, otherwise the sql of the metric
+func (config *Config) MetricSQL(mPos, tPos int) string {
+	for name, sel := range config.Tenants[tPos].MetricSQL {
+		if strings.EqualFold(name, config.Metrics[mPos].Name) {
+			return sel
+		}
+	}
+	return config.Metrics[mPos].SQL
+}
+
+// GetGateSelection - prepare the gating query of the metric
+func (config *Config) GetGateSelection(mPos, tPos int) string {
+	schema := FirstValueInSlice(config.Metrics[mPos].SchemaFilter, config.schemasOf(tPos))
+	return strings.ReplaceAll(strings.TrimSpace(config.Metrics[mPos].GateSQL), "<SCHEMA>", schema)
+}
+
+// MemoryLimitConn - dedicated connection with the statement memory limit in GB
+// as session variable, so that hana aborts the query instead of pressuring the
+// system. The release function resets the variable and returns the connection
+// to the pool.
+func MemoryLimitConn(ctx context.Context, db *sql.DB, limit string) (*sql.Conn, func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "MemoryLimitConn(Conn)")
+	}
+	if _, err = conn.ExecContext(ctx, "set 'STATEMENT_MEMORY_LIMIT' = '"+limit+"'"); err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "MemoryLimitConn(ExecContext)")
+	}
+
+	release := func() {
+		if _, err := conn.ExecContext(context.Background(), "unset 'STATEMENT_MEMORY_LIMIT'"); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Can't reset statement memory limit")
+		}
+		conn.Close()
+	}
+	return conn, release, nil
+}
+
+// GateOpen - true, if the gating query returns true or a count > 0
+func GateOpen(ctx context.Context, db *sql.DB, gate string) (bool, error) {
+
+	if !IsSelect(gate) {
+		return false, errors.New("GateOpen(only selects are allowed)")
+	}
+
+	var res sql.NullString
+	if err := db.QueryRowContext(ctx, gate).Scan(&res); err != nil {
+		return false, errors.Wrap(err, "GateOpen(Scan)")
+	}
+	if !res.Valid {
+		return false, nil
+	}
+
+	if b, err := strconv.ParseBool(res.String); err == nil {
+		return b, nil
+	}
+	cnt, err := strconv.ParseFloat(res.String, 64)
+	if err != nil {
+		return false, errors.Wrap(err, "GateOpen(ParseFloat)")
+	}
+	return cnt > 0, nil
+}
+
+// GetMetricRows - return the metric values
+func (tenant *TenantInfo) GetMetricRows(rows *sql.Rows, metric *MetricInfo) ([]MetricRecord, error) {
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMetricRows(rows.Columns)")
+	}
+
+	if len(cols) < 1 {
+		return nil, errors.New("GetMetricRows(no columns)")
+	}
+
+	// info metrics have no value column, all columns are labels
+	info := "info" == low(metric.ValueMode)
+
+	// the value column is the first column, unless it is named explicitly
+	vPos := 0
+	if info {
+		vPos = -1
+	} else if "" != metric.ValueColumn {
+		vPos = -1
+		for i, col := range cols {
+			if strings.EqualFold(col, metric.ValueColumn) {
+				vPos = i
+				break
+			}
+		}
+		if vPos < 0 {
+			return nil, errors.New("GetMetricRows(value column not found)")
+		}
+	}
+
+	// with several value columns every value column becomes its own metric
+	// with the column name as suffix
+	var valueCols []int
+	for _, name := range metric.ValueColumns {
+		pos := -1
+		for i, col := range cols {
+			if strings.EqualFold(col, name) {
+				pos = i
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, errors.Errorf("GetMetricRows(value column %s not found)", name)
+		}
+		if !metricNameRE.MatchString(metric.Name + "_" + low(name)) {
+			return nil, errors.Errorf("GetMetricRows(value column %s gives no valid metric name)", name)
+		}
+		valueCols = append(valueCols, pos)
+	}
+	if len(valueCols) > 0 {
+		vPos = valueCols[0]
+	}
+
+	colt, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMetricRows(rows.ColumnTypes)")
+	}
+
+	// with automatic value column the first numeric column is the value, if
+	// the first column can't be one
+	if !info && metric.AutoValueColumn && "" == metric.ValueColumn && 0 == len(valueCols) && "" == metric.ValueFormat && !tenant.valueScanType(colt[0].ScanType().Name()) {
+		for i := range colt {
+			if numericScanType(colt[i].ScanType().Name()) {
+				vPos = i
+				if _, logged := autoValueColumns.LoadOrStore(metric.Name, cols[i]); !logged {
+					log.WithFields(log.Fields{
+						"metric": metric.Name,
+						"column": cols[i],
+					}).Info("First numeric column selected as value column of metric.")
+				}
+				break
+			}
+		}
+	}
+
+	// value column must not be string, unless it is hex or binary encoded or
+	// a decimal with comma returned as string
+	if !info && "" == metric.ValueFormat && !tenant.valueScanType(colt[vPos].ScanType().Name()) {
+		return nil, errValueNotNumeric
+	}
+	for _, pos := range valueCols {
+		if "" == metric.ValueFormat && !tenant.valueScanType(colt[pos].ScanType().Name()) {
+			return nil, errValueNotNumeric
+		}
+	}
+
+	isValue := make([]bool, len(cols))
+	for _, pos := range valueCols {
+		isValue[pos] = true
+	}
+	if vPos >= 0 {
+		isValue[vPos] = true
+	}
+
+	// the description column of info metrics becomes the label description
+	descPos := -1
+	if "" != metric.DescColumn {
+		for i, col := range cols {
+			if strings.EqualFold(col, metric.DescColumn) {
+				descPos = i
+				break
+			}
+		}
+		if descPos < 0 {
+			return nil, errors.Errorf("GetMetricRows(description column %s not found)", metric.DescColumn)
+		}
+	}
+
+	// the column with the maximum of the value of the row is no label
+	maxPos := -1
+	if "" != metric.MaxColumn {
+		for i, col := range cols {
+			if strings.EqualFold(col, metric.MaxColumn) {
+				maxPos = i
+				break
+			}
+		}
+		if maxPos < 0 || isValue[maxPos] {
+			return nil, errors.Errorf("GetMetricRows(maximum column %s not found or value column)", metric.MaxColumn)
+		}
+	}
+
+	// the column with the time of the measurement is no label
+	timePos := -1
+	if "" != metric.TimeColumn {
+		for i, col := range cols {
+			if strings.EqualFold(col, metric.TimeColumn) {
+				timePos = i
+				break
+			}
+		}
+		if timePos < 0 || isValue[timePos] {
+			return nil, errors.Errorf("GetMetricRows(time column %s not found or value column)", metric.TimeColumn)
+		}
+	}
+
+	// columns, which are no labels of the metric, are ignored
+	labelCols := make([]string, len(cols))
+	for i, col := range cols {
+		if metric.LabelColumn(col) && !isValue[i] && i != descPos && i != maxPos && i != timePos {
+			labelCols[i], err = StripLabelPrefix(col, metric.StripPrefixes)
+			if err != nil {
+				return nil, errors.Wrap(err, "GetMetricRows(StripLabelPrefix)")
+			}
+		}
+	}
+	labels, err := LabelNames(labelCols, vPos, metric.DuplicateLabels, metric.preserveCase(), metric.reserved...)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMetricRows(LabelNames)")
+	}
+	if descPos >= 0 && ContainsString("description", labels) {
+		return nil, errors.New("GetMetricRows(label description of the description column already exists)")
+	}
+
+	values := make([]sql.RawBytes, len(cols))
+	scanArgs := make([]interface{}, len(values))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	var md []MetricRecord
+	rowValues := make([]float64, len(cols))
+	nullMode := low(metric.NullMode)
+
+	// the words of label values are joined with underscores by default
+	separator := "_"
+	if nil != metric.WordSeparator {
+		separator = *metric.WordSeparator
+	}
+	for rowCnt := uint(0); rows.Next(); rowCnt++ {
+
+		// the row cap protects against an unexpected number of series
+		if metric.MaxRows > 0 && rowCnt >= metric.MaxRows {
+			log.WithFields(log.Fields{
+				"metric": metric.Name,
+				"tenant": tenant.Name,
+				"limit":  metric.MaxRows,
+			}).Warn("Row limit of metric exceeded - remaining rows ignored.")
+			break
+		}
+
+		data := MetricRecord{
+			Labels:      []string{"tenant", "usage"},
+			LabelValues: []string{low(tenant.Name), low(tenant.Usage)},
+		}
+		if info {
+			data.Value = 1
+		}
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetMetricRows(rows.Scan)")
+		}
+
+		skip := false
+		for i, colval := range values {
+
+			// check for NULL value, depending on the null mode the value
+			// becomes zero, the label empty or the row is skipped. Columns,
+			// which are neither value nor label, are not affected.
+			if colval == nil {
+				switch {
+				case i == maxPos:
+					rowValues[i] = math.Inf(1)
+					continue
+				case i == timePos:
+					continue
+				case !isValue[i] && i != descPos && "" == labels[i]:
+					continue
+				case isValue[i] && (metric.NullAsZero || "zero" == nullMode):
+					rowValues[i] = 0
+					continue
+				case !isValue[i] && ("zero" == nullMode || "empty" == nullMode):
+					label := labels[i]
+					if i == descPos {
+						label = "description"
+					}
+					data.Labels = append(data.Labels, label)
+					data.LabelValues = append(data.LabelValues, "")
+					continue
+				case "skip" == nullMode || "empty" == nullMode:
+					skip = true
+					continue
+				}
+				return nil, errors.Errorf("GetMetricRows(column %s is null)", cols[i])
+			}
+
+			if isValue[i] {
+
+				// the value column must be the float value
+				if "," == tenant.DecimalSeparator && "" == metric.ValueFormat {
+					colval = NormalizeDecimal(colval)
+				}
+				rowValues[i], err = ParseValue(colval, metric.ValueFormat)
+				if err != nil {
+					return nil, errors.Wrap(err, "GetMetricRows(ParseValue - value column cannot be converted to float64)")
+				}
+				if math.IsNaN(rowValues[i]) && (metric.NullAsZero || "zero" == nullMode) {
+					rowValues[i] = 0
+				}
+			} else if i == maxPos {
+
+				// the maximum is parsed like the value
+				if "," == tenant.DecimalSeparator && "" == metric.ValueFormat {
+					colval = NormalizeDecimal(colval)
+				}
+				rowValues[i], err = ParseValue(colval, metric.ValueFormat)
+				if err != nil {
+					return nil, errors.Wrap(err, "GetMetricRows(ParseValue - maximum column cannot be converted to float64)")
+				}
+			} else if i == timePos {
+				data.Timestamp, err = ParseTimestamp(colval)
+				if err != nil {
+					return nil, errors.Wrap(err, "GetMetricRows(ParseTimestamp)")
+				}
+			} else if i == descPos {
+				data.Labels = append(data.Labels, "description")
+				data.LabelValues = append(data.LabelValues, Description(string(colval)))
+			} else if "" == labels[i] {
+				continue
+			} else if step, ok := labelBucket(metric.LabelBuckets, cols[i]); ok {
+
+				// numeric label columns can be rounded to reduce the cardinality
+				value, err := strconv.ParseFloat(strings.TrimSpace(string(colval)), 64)
+				if err != nil {
+					return nil, errors.Wrap(err, "GetMetricRows(bucketed label column "+labels[i]+" must be numeric)")
+				}
+				data.Labels = append(data.Labels, labels[i])
+				data.LabelValues = append(data.LabelValues, BucketValue(value, step))
+			} else {
+				data.Labels = append(data.Labels, labels[i])
+				data.LabelValues = append(data.LabelValues, metric.caseOf(strings.Join(strings.Split(string(colval), " "), separator)))
+
+			}
+		}
+		if skip {
+			continue
+		}
+
+		// stale measurements are not exported
+		if metric.MaxAge > 0 && !data.Timestamp.IsZero() && time.Since(data.Timestamp).Seconds() > metric.MaxAge {
+			log.WithFields(log.Fields{
+				"metric":    metric.Name,
+				"tenant":    tenant.Name,
+				"timestamp": data.Timestamp,
+			}).Debug("Stale sample of metric skipped.")
+			continue
+		}
+
+		// values above the maximum of the metric or the row are capped
+		max := math.Inf(1)
+		if nil != metric.MaxValue {
+			max = *metric.MaxValue
+		}
+		if maxPos >= 0 {
+			max = math.Min(max, rowValues[maxPos])
+		}
+		for i := range rowValues {
+			if isValue[i] && rowValues[i] > max {
+				rowValues[i] = max
+			}
+		}
+
+		// one record per value column with its own copy of the labels
+		if len(valueCols) > 0 {
+			for _, pos := range valueCols {
+				record := data
+				record.Labels = append([]string(nil), data.Labels...)
+				record.LabelValues = append([]string(nil), data.LabelValues...)
+				record.Value = rowValues[pos]
+				record.Suffix = low(cols[pos])
+				md = append(md, record)
+			}
+			continue
+		}
+		if vPos >= 0 {
+			data.Value = rowValues[vPos]
+		}
+		md = append(md, data)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "GetMetricRows(rows)")
+	}
+
+	return md, nil
+}
+
+// ParseTimestamp - time of a timestamp column, either converted by the driver
+// or a HANA timestamp string, which is UTC
+func ParseTimestamp(colval []byte) (time.Time, error) {
+	str := strings.TrimSpace(string(colval))
+	for _, layout := range []string{time.RFC3339Nano, hanaTimestampFormat} {
+		if ts, err := time.Parse(layout, str); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("ParseTimestamp(%s is no timestamp)", str)
+}
+
+// Description - description text as label value: trimmed, with single spaces
+// and at most maxDescriptionLength characters
+func Description(text string) string {
+	desc := []rune(strings.Join(strings.Fields(text), " "))
+	if len(desc) > maxDescriptionLength {
+		desc = desc[:maxDescriptionLength]
+	}
+	return strings.TrimSpace(string(desc))
+}
+
+// GetSummaryRows - return the summary of a metric with type summary. The
+// first column is the count, the second the sum and the remaining columns are
+// pairs of quantile and its value, e.g. "select count(*), sum(duration), 0.5,
+// percentile_cont(0.5) within group (order by duration), 0.9, ...". The
+// summary gets the labels tenant and usage.
+func (tenant *TenantInfo) GetSummaryRows(rows *sql.Rows) ([]MetricRecord, error) {
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetSummaryRows(rows.Columns)")
+	}
+	if len(cols) < 4 || len(cols)%2 != 0 {
+		return nil, errors.Errorf("GetSummaryRows(%d columns - count, sum and pairs of quantile and value expected)", len(cols))
+	}
+
+	values := make([]sql.RawBytes, len(cols))
+	scanArgs := make([]interface{}, len(values))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	var md []MetricRecord
+	for rows.Next() {
+		if len(md) > 0 {
+			return nil, errors.New("GetSummaryRows(more than one row)")
+		}
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetSummaryRows(rows.Scan)")
+		}
+
+		numbers := make([]float64, len(values))
+		for i, colval := range values {
+			if colval == nil {
+				return nil, errors.Errorf("GetSummaryRows(column %s is null)", cols[i])
+			}
+			if "," == tenant.DecimalSeparator {
+				colval = NormalizeDecimal(colval)
+			}
+			numbers[i], err = strconv.ParseFloat(strings.TrimSpace(string(colval)), 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "GetSummaryRows(column %s must be numeric)", cols[i])
+			}
+		}
+
+		if numbers[0] < 0 || numbers[0] != math.Trunc(numbers[0]) {
+			return nil, errors.Errorf("GetSummaryRows(count %v is no natural number)", numbers[0])
+		}
+		summary := &SummaryData{
+			Quantiles: make(map[float64]float64),
+			Count:     uint64(numbers[0]),
+			Sum:       numbers[1],
+		}
+		for i := 2; i < len(numbers); i += 2 {
+			if numbers[i] < 0 || numbers[i] > 1 {
+				return nil, errors.Errorf("GetSummaryRows(quantile %v of column %s not between 0 and 1)", numbers[i], cols[i])
+			}
+			summary.Quantiles[numbers[i]] = numbers[i+1]
+		}
+
+		md = append(md, MetricRecord{
+			Value:       numbers[0],
+			Labels:      []string{"tenant", "usage"},
+			LabelValues: []string{low(tenant.Name), low(tenant.Usage)},
+			Summary:     summary,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "GetSummaryRows(rows)")
+	}
+	return md, nil
+}
+
+// metrics, whose automatically selected value column has been logged
+var autoValueColumns sync.Map
 
-			metricC <- config.DataFunc(mPos, tPos)
-		}(tPos)
+// true, if the column type can be the value of the tenant without value format
+func (tenant *TenantInfo) valueScanType(name string) bool {
+	if "string" == name {
+		return "," == tenant.DecimalSeparator
 	}
+	return "bool" != name && "" != name
+}
 
-	// collect data
-	var sData []MetricRecord
-	for i := 0; i < tenantCnt; i++ {
-		select {
-		case mc := <-metricC:
-			if mc != nil {
-				sData = append(sData, mc...)
-			}
-		case <-ctx.Done():
-			return sData
-		}
+// true, if the column type is numeric
+func numericScanType(name string) bool {
+	switch name {
+	case "string", "bool", "", "Time", "NullTime", "RawBytes":
+		return false
 	}
-	return sData
+	return true
 }
 
-// GetMetricData - metric data for one tenant
-func (config *Config) GetMetricData(mPos, tPos int) []MetricRecord {
+// HistogramRecords - combine the bucket rows of histogram metrics: every row
+// is one bucket with its upper bound in the label le, the cumulative count as
+// value and the sum of the observations in the label sum. Rows with the same
+// remaining labels form one histogram. The count is the one of the +Inf
+// bucket or, if there is none, the one of the largest bucket.
+func HistogramRecords(md []MetricRecord, separator string) ([]MetricRecord, error) {
 
-	sel := config.GetSelection(mPos, tPos)
-	if "" == sel {
-		return nil
+	parse := func(value string) (float64, error) {
+		if "," == separator {
+			value = string(NormalizeDecimal([]byte(value)))
+		}
+		return strconv.ParseFloat(value, 64)
 	}
 
-	rows, err := config.Tenants[tPos].conn.Query(sel)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-			"error":  err,
-		}).Error("Can't get sql result for metric")
-		return nil
+	type histogram struct {
+		rec    MetricRecord
+		hasInf bool
 	}
-	defer rows.Close()
+	var hists []*histogram
+	pos := make(map[string]*histogram)
 
-	md, err := config.Tenants[tPos].GetMetricRows(rows)
-	// if err = rows.Err(); err != nil {
-	if err != nil {
-		return nil
-	}
-	return md
-}
+	for _, rec := range md {
+		lePos, sumPos := -1, -1
+		var labels, labelValues []string
+		for i, label := range rec.Labels {
 
-// GetSelection - prepare the db selection
-func (config *Config) GetSelection(mPos, tPos int) string {
+			// the columns keep their case with preserve_case
+			switch low(label) {
+			case "le":
+				lePos = i
+			case "sum":
+				sumPos = i
+			default:
+				labels = append(labels, label)
+				labelValues = append(labelValues, rec.LabelValues[i])
+			}
+		}
+		if lePos < 0 || sumPos < 0 {
+			return nil, errors.New("HistogramRecords(columns le and sum required)")
+		}
 
-	// all values of metrics tag filter must be in tenants tags, otherwise the
-	// metric is not relevant for the tenant
-	if !SubSliceInSlice(config.Metrics[mPos].TagFilter, config.Tenants[tPos].Tags) {
-		return ""
+		le, err := parse(rec.LabelValues[lePos])
+		if err != nil {
+			return nil, errors.Wrap(err, "HistogramRecords(le must be numeric)")
+		}
+		sum, err := parse(rec.LabelValues[sumPos])
+		if err != nil {
+			return nil, errors.Wrap(err, "HistogramRecords(sum must be numeric)")
+		}
+		if rec.Value < 0 || rec.Value != math.Trunc(rec.Value) {
+			return nil, errors.Errorf("HistogramRecords(bucket count %v is no natural number)", rec.Value)
+		}
+		count := uint64(rec.Value)
+
+		key := strings.Join(labels, "\x00") + "\x01" + strings.Join(labelValues, "\x00")
+		h, ok := pos[key]
+		if !ok {
+			h = &histogram{rec: rec}
+			h.rec.Labels = labels
+			h.rec.LabelValues = labelValues
+			h.rec.Histogram = &HistogramData{Buckets: make(map[float64]uint64), Sum: sum}
+			pos[key] = h
+			hists = append(hists, h)
+		}
+		if h.rec.Histogram.Sum != sum {
+			return nil, errors.New("HistogramRecords(different sums of one histogram)")
+		}
+
+		if math.IsInf(le, 1) {
+			if h.hasInf {
+				return nil, errors.New("HistogramRecords(duplicate +Inf bucket)")
+			}
+			h.hasInf = true
+			h.rec.Histogram.Count = count
+			continue
+		}
+		if _, ok := h.rec.Histogram.Buckets[le]; ok {
+			return nil, errors.Errorf("HistogramRecords(duplicate bucket %v)", le)
+		}
+		h.rec.Histogram.Buckets[le] = count
 	}
 
-	sel := strings.TrimSpace(config.Metrics[mPos].SQL)
-	if !strings.EqualFold(sel[0:6], "select") {
-		log.WithFields(log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("Only selects are allowed")
-		return ""
+	var res []MetricRecord
+	for _, h := range hists {
+		bounds := make([]float64, 0, len(h.rec.Histogram.Buckets))
+		for le := range h.rec.Histogram.Buckets {
+			bounds = append(bounds, le)
+		}
+		sort.Float64s(bounds)
+
+		// the bucket counts must be cumulative
+		var last uint64
+		for _, le := range bounds {
+			if h.rec.Histogram.Buckets[le] < last {
+				return nil, errors.Errorf("HistogramRecords(bucket %v is not cumulative)", le)
+			}
+			last = h.rec.Histogram.Buckets[le]
+		}
+		if !h.hasInf {
+			h.rec.Histogram.Count = last
+		} else if h.rec.Histogram.Count < last {
+			return nil, errors.New("HistogramRecords(+Inf bucket is not cumulative)")
+		}
+		h.rec.Value = float64(h.rec.Histogram.Count)
+		res = append(res, h.rec)
 	}
+	return res, nil
+}
 
-	// metrics schema filter must include a tenant schema
-	var schema string
-	if schema = FirstValueInSlice(config.Metrics[mPos].SchemaFilter, config.Tenants[tPos].Schemas); 0 == len(schema) {
-		log.WithFields(log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("metrics schema filter must include a tenant schema")
-		return ""
+// TableSizeMetrics - built-in metrics with the memory and disk size of the
+// largest tables. The number of tables is bounded by the top clause and the
+// row cap of the metrics.
+func TableSizeMetrics(topN uint) []MetricInfo {
+	return []MetricInfo{
+		{
+			Name:         "hdb_table_memory_size_bytes",
+			Help:         "Memory size of the largest column store tables including all partitions.",
+			MetricType:   "gauge",
+			SchemaFilter: []string{"sys"},
+			SQL:          fmt.Sprintf("select top %d sum(memory_size_in_total) as memory_size, schema_name, table_name from <SCHEMA>.m_cs_tables group by schema_name, table_name order by memory_size desc", topN),
+			MaxRows:      topN,
+		},
+		{
+			Name:         "hdb_table_disk_size_bytes",
+			Help:         "Disk size of the largest tables.",
+			MetricType:   "gauge",
+			SchemaFilter: []string{"sys"},
+			SQL:          fmt.Sprintf("select top %d disk_size, schema_name, table_name from <SCHEMA>.m_table_persistence_statistics order by disk_size desc", topN),
+			MaxRows:      topN,
+		},
 	}
-	return strings.ReplaceAll(config.Metrics[mPos].SQL, "<SCHEMA>", schema)
 }
 
-// GetMetricRows - return the metric values
-func (tenant *TenantInfo) GetMetricRows(rows *sql.Rows) ([]MetricRecord, error) {
+// LabelNames - label names of the columns without the value column, lowercased
+// unless the case should be preserved. Columns resulting in the same label name
+// fail, unless duplicates should be suffixed.
+func LabelNames(cols []string, vPos int, duplicates string, preserve bool, reserved ...string) ([]string, error) {
 
-	cols, err := rows.Columns()
-	if err != nil {
-		return nil, errors.Wrap(err, "GetMetricRows(rows.Columns)")
+	// default labels of every metric and the ones added by the exporter
+	used := map[string]bool{"tenant": true, "usage": true}
+	for _, label := range reserved {
+		used[label] = true
 	}
 
-	if len(cols) < 1 {
-		return nil, errors.New("GetMetricRows(no columns)")
-	}
+	labels := make([]string, len(cols))
+	for i, col := range cols {
+		if i == vPos || "" == col {
+			continue
+		}
 
-	// first column must not be string
-	colt, err := rows.ColumnTypes()
-	if err != nil {
-		return nil, errors.Wrap(err, "GetMetricRows(rows.ColumnTypes)")
+		label := col
+		if !preserve {
+			label = low(col)
+		}
+		name := label
+		if used[label] {
+			if "suffix" != low(duplicates) {
+				return nil, errors.Errorf("duplicate label %s - rename the column or use DuplicateLabels = \"suffix\"", label)
+			}
+			for n := 2; used[label]; n++ {
+				label = name + "_" + strconv.Itoa(n)
+			}
+		}
+		used[label] = true
+		labels[i] = label
 	}
-	switch colt[0].ScanType().Name() {
-	case "string", "bool", "":
-		return nil, errors.New("GetMetricRows(first column must be numeric)")
-	default:
+	return labels, nil
+}
+
+// StripLabelPrefix - remove the first matching prefix from the column name of a
+// label, case insensitive. The rest must still be a valid label name.
+func StripLabelPrefix(col string, prefixes []string) (string, error) {
+	for _, prefix := range prefixes {
+		if len(col) < len(prefix) || !strings.EqualFold(col[:len(prefix)], prefix) {
+			continue
+		}
+		label := col[len(prefix):]
+		if !labelNameRE.MatchString(label) {
+			return "", errors.Errorf("column %s without prefix %s is no valid label name", col, prefix)
+		}
+		return label, nil
 	}
+	return col, nil
+}
 
-	values := make([]sql.RawBytes, len(cols))
-	scanArgs := make([]interface{}, len(values))
-	for i := range values {
-		scanArgs[i] = &values[i]
+// LabelColumn - true, if the column is a label of the metric: it must be in
+// the LabelColumns allow-list, if there is one, and not in the DropColumns
+func (metric *MetricInfo) LabelColumn(col string) bool {
+	if len(metric.LabelColumns) > 0 && !ContainsString(col, metric.LabelColumns) {
+		return false
 	}
+	return !ContainsString(col, metric.DropColumns)
+}
 
-	var md []MetricRecord
-	for rows.Next() {
-		data := MetricRecord{
-			Labels:      []string{"tenant", "usage"},
-			LabelValues: []string{low(tenant.Name), low(tenant.Usage)},
+// bucket size of the label column, if it should be rounded
+func labelBucket(buckets map[string]float64, col string) (float64, bool) {
+	for name, step := range buckets {
+		if strings.EqualFold(name, col) {
+			return step, true
 		}
-		err = rows.Scan(scanArgs...)
+	}
+	return 0, false
+}
+
+// BucketValue - round the value to the nearest multiple of the bucket size
+func BucketValue(value, step float64) string {
+	return strconv.FormatFloat(math.Round(value/step)*step, 'f', -1, 64)
+}
+
+// NormalizeDecimal - replace the decimal comma of a value by a dot
+func NormalizeDecimal(colval []byte) []byte {
+	return []byte(strings.Replace(string(colval), ",", ".", 1))
+}
+
+// ParseValue - convert the value column according to the value format of the
+// metric: decimal (default), hex string or big-endian binary integer
+func ParseValue(colval []byte, format string) (float64, error) {
+
+	switch low(format) {
+	case "":
+		return strconv.ParseFloat(string(colval), 64)
+	case "hex":
+		hex := strings.TrimPrefix(low(string(colval)), "0x")
+		value, err := strconv.ParseUint(hex, 16, 64)
 		if err != nil {
-			return nil, errors.Wrap(err, "GetMetricRows(rows.Scan)")
+			return 0, errors.Wrap(err, "ParseValue(ParseUint)")
+		}
+		return float64(value), nil
+	case "binary":
+		if len(colval) == 0 || len(colval) > 8 {
+			return 0, errors.New("ParseValue(binary value must have 1 to 8 bytes)")
 		}
+		var value uint64
+		for _, b := range colval {
+			value = value<<8 | uint64(b)
+		}
+		return float64(value), nil
+	}
+	return 0, errors.New("ParseValue(unknown value format)")
+}
 
-		for i, colval := range values {
+// ValidateMetrics - check the metric definitions before starting the exporter
+func (config *Config) ValidateMetrics() error {
 
-			// check for NULL value
-			if colval == nil {
-				return nil, errors.Wrap(err, "GetMetricRows(colval is null)")
+	// the endpoints of the groups must be distinct paths below /metrics
+	groups := make(map[string]bool)
+	for _, group := range config.Groups {
+		name := low(group.Name)
+		if !groupNameRE.MatchString(name) {
+			return errors.Errorf("group %q: name must consist of letters, digits, _ and -", group.Name)
+		}
+		if groups[name] {
+			return errors.Errorf("group %s: duplicate name", group.Name)
+		}
+		groups[name] = true
+	}
+	if config.TagsLabel {
+		for _, tenant := range config.Tenants {
+			if len(strings.Join(tenant.Tags, ",")) > maxLabelValueLength {
+				return errors.Errorf("tenant %s: joined tags are too long for the tags label", tenant.Name)
+			}
+		}
+	}
+	for _, metric := range config.Metrics {
+		if _, err := RenderHelp(metric.Help, HelpData{}); err != nil {
+			return errors.Errorf("metric %s: invalid help template: %v", metric.Name, err)
+		}
+		for tPos := range config.Tenants {
+			prefix := config.MetricPrefix(tPos)
+			if "" != prefix && !metricNameRE.MatchString(prefix+"_"+metric.Name) {
+				return errors.Errorf("metric %s: invalid name with prefix %s of tenant %s", metric.Name, prefix, config.Tenants[tPos].Name)
+			}
+		}
+		switch low(metric.ValueFormat) {
+		case "", "hex", "binary":
+		default:
+			return errors.Errorf("metric %s: unknown value format %s", metric.Name, metric.ValueFormat)
+		}
+		for col, step := range metric.LabelBuckets {
+			if step <= 0 {
+				return errors.Errorf("metric %s: bucket size of label %s must be positive", metric.Name, col)
+			}
+		}
+		switch low(metric.DuplicateLabels) {
+		case "", "fail", "suffix":
+		default:
+			return errors.Errorf("metric %s: unknown duplicate label handling %s", metric.Name, metric.DuplicateLabels)
+		}
+		switch low(metric.Connection) {
+		case "", "tenant", "system":
+		default:
+			return errors.Errorf("metric %s: unknown connection %s", metric.Name, metric.Connection)
+		}
+		if "" != metric.Pool && !config.poolExists(metric.Pool) {
+			return errors.Errorf("metric %s: unknown pool %s", metric.Name, metric.Pool)
+		}
+		switch low(metric.CounterFraction) {
+		case "", "warn", "round", "accept":
+		default:
+			return errors.Errorf("metric %s: unknown counter fraction handling %s", metric.Name, metric.CounterFraction)
+		}
+		if metric.MaskTenant && "" == config.MaskKey {
+			for tPos := range config.Tenants {
+				if "" == config.Tenants[tPos].Alias {
+					return errors.Errorf("metric %s: masked tenant %s needs an alias or the global mask key", metric.Name, config.Tenants[tPos].Name)
+				}
+			}
+		}
+		if metric.MaskTenant && config.TenantPrefix {
+			for tPos := range config.Tenants {
+				if "" == config.Tenants[tPos].MetricPrefix {
+					return errors.Errorf("metric %s: masked tenant %s would be revealed by its metric prefix", metric.Name, config.Tenants[tPos].Name)
+				}
+			}
+		}
+		if "" != metric.GlobalTenant && !config.tenantExists(metric.GlobalTenant) {
+			return errors.Errorf("metric %s: unknown global tenant %s", metric.Name, metric.GlobalTenant)
+		}
+		switch low(metric.ValueMode) {
+		case "", "value", "info":
+		default:
+			return errors.Errorf("metric %s: unknown value mode %s", metric.Name, metric.ValueMode)
+		}
+		if "" != metric.DescColumn && "info" != low(metric.ValueMode) {
+			return errors.Errorf("metric %s: description column requires value mode info", metric.Name)
+		}
+		if len(metric.ValueColumns) > 0 && ("" != metric.ValueColumn || "info" == low(metric.ValueMode) ||
+			"histogram" == low(metric.MetricType) || "summary" == low(metric.MetricType)) {
+			return errors.Errorf("metric %s: value columns exclude value column, info mode, histograms and summaries", metric.Name)
+		}
+		switch low(metric.NullMode) {
+		case "", "error", "skip", "zero", "empty":
+		default:
+			return errors.Errorf("metric %s: unknown null mode %s", metric.Name, metric.NullMode)
+		}
+		switch low(metric.InvalidValues) {
+		case "", "keep", "drop", "cap":
+		default:
+			return errors.Errorf("metric %s: unknown invalid value handling %s", metric.Name, metric.InvalidValues)
+		}
+		switch low(metric.NegativeValues) {
+		case "", "keep", "abs", "zero", "drop":
+		default:
+			return errors.Errorf("metric %s: unknown negative value handling %s", metric.Name, metric.NegativeValues)
+		}
+		if "" != metric.MemoryLimit && !memoryLimitRE.MatchString(metric.MemoryLimit) {
+			return errors.Errorf("metric %s: statement memory limit %s must be a number of GB", metric.Name, metric.MemoryLimit)
+		}
+		if metric.ValueLimit < 0 {
+			return errors.Errorf("metric %s: value limit must not be negative", metric.Name)
+		}
+		if metric.Timeout < 0 || math.IsNaN(metric.Timeout) {
+			return errors.Errorf("metric %s: timeout must not be negative", metric.Name)
+		}
+		if nil != metric.MaxValue && (math.IsNaN(*metric.MaxValue) || math.IsInf(*metric.MaxValue, 0)) {
+			return errors.Errorf("metric %s: maximum value must be a finite number", metric.Name)
+		}
+		if "" != metric.MaxColumn && (!labelNameRE.MatchString(metric.MaxColumn) || strings.EqualFold(metric.MaxColumn, metric.ValueColumn) ||
+			ContainsString(metric.MaxColumn, metric.ValueColumns)) {
+			return errors.Errorf("metric %s: maximum column %s must be a column name other than the value columns", metric.Name, metric.MaxColumn)
+		}
+		if "" != metric.TimeColumn && (!labelNameRE.MatchString(metric.TimeColumn) || strings.EqualFold(metric.TimeColumn, metric.ValueColumn) ||
+			ContainsString(metric.TimeColumn, metric.ValueColumns) || strings.EqualFold(metric.TimeColumn, metric.MaxColumn)) {
+			return errors.Errorf("metric %s: time column %s must be a column name other than the value and maximum columns", metric.Name, metric.TimeColumn)
+		}
+		if "" != metric.TimeColumn && ("histogram" == low(metric.MetricType) || "summary" == low(metric.MetricType)) {
+			return errors.Errorf("metric %s: time column excludes histograms and summaries", metric.Name)
+		}
+		if metric.MaxAge < 0 || math.IsNaN(metric.MaxAge) || (metric.MaxAge > 0 && "" == metric.TimeColumn) {
+			return errors.Errorf("metric %s: maximum age must not be negative and requires a time column", metric.Name)
+		}
+		if (nil != metric.MaxValue || "" != metric.MaxColumn) && ("info" == low(metric.ValueMode) ||
+			"histogram" == low(metric.MetricType) || "summary" == low(metric.MetricType)) {
+			return errors.Errorf("metric %s: maximum excludes info mode, histograms and summaries", metric.Name)
+		}
+		if nil != metric.FilteredValue && ("histogram" == low(metric.MetricType) || "summary" == low(metric.MetricType)) {
+			return errors.Errorf("metric %s: filtered value excludes histograms and summaries", metric.Name)
+		}
+		for _, param := range metric.Params {
+			if !paramNameRE.MatchString(param) {
+				return errors.Errorf("metric %s: invalid parameter name %s", metric.Name, param)
+			}
+		}
+	}
+	for _, tenant := range config.Tenants {
+		for name, sel := range tenant.MetricSQL {
+			if !config.metricExists(name) {
+				return errors.Errorf("tenant %s: sql of unknown metric %s", tenant.Name, name)
+			}
+			if !IsSelect(sel) && !IsProcedureCall(sel) {
+				return errors.Errorf("tenant %s: sql of metric %s must be a select or a procedure call", tenant.Name, name)
 			}
+		}
+	}
+	return nil
+}
 
-			if 0 == i {
+// true, if the metric is configured
+func (config *Config) metricExists(name string) bool {
+	for _, metric := range config.Metrics {
+		if strings.EqualFold(metric.Name, name) {
+			return true
+		}
+	}
+	return false
+}
 
-				// the first column must be the float value
-				data.Value, err = strconv.ParseFloat(string(colval), 64)
-				if err != nil {
-					return nil, errors.Wrap(err, "GetMetricRows(ParseFloat - first column cannot be converted to float64)")
-				}
-			} else {
-				data.Labels = append(data.Labels, low(cols[i]))
-				data.LabelValues = append(data.LabelValues, low(strings.Join(strings.Split(string(colval), " "), "_")))
+// true, if the tenant is configured
+func (config *Config) tenantExists(name string) bool {
+	for _, tenant := range config.Tenants {
+		if strings.EqualFold(tenant.Name, name) {
+			return true
+		}
+	}
+	return false
+}
 
-			}
+// true, if the pool is configured
+func (config *Config) poolExists(name string) bool {
+	for _, pool := range config.Pools {
+		if strings.EqualFold(pool.Name, name) {
+			return true
 		}
-		md = append(md, data)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, errors.Wrap(err, "GetMetricRows(rows)")
+	return false
+}
+
+// InheritStripPrefixes - metrics without own prefixes, which are stripped
+// from the label names, use the global ones
+func (config *Config) InheritStripPrefixes() {
+	for i := range config.Metrics {
+		if nil == config.Metrics[i].StripPrefixes {
+			config.Metrics[i].StripPrefixes = config.StripPrefixes
+		}
 	}
+}
 
-	return md, nil
+// InheritWordSeparator - metrics without own separator for the words of label
+// values use the global one
+func (config *Config) InheritWordSeparator() {
+	for i := range config.Metrics {
+		if nil == config.Metrics[i].WordSeparator {
+			config.Metrics[i].WordSeparator = config.WordSeparator
+		}
+	}
+}
+
+// InheritPreserveCase - metrics without own case handling of label names and
+// values use the global one
+func (config *Config) InheritPreserveCase() {
+	for i := range config.Metrics {
+		if nil == config.Metrics[i].PreserveCase {
+			config.Metrics[i].PreserveCase = config.PreserveCase
+		}
+	}
 }
 
-// add missing information to tenant struct
-func (config *Config) prepare() ([]TenantInfo, error) {
+// InheritReservedLabels - the labels, which the exporter adds to all records,
+// can't be used by columns of the metrics
+func (config *Config) InheritReservedLabels() {
+	var reserved []string
+	if config.TagsLabel {
+		reserved = append(reserved, "tags")
+	}
+	if config.SourceLabel {
+		reserved = append(reserved, "source")
+	}
+	for i := range config.Metrics {
+		config.Metrics[i].reserved = reserved
+	}
+}
+
+// preserveCase - true, if label names and values of the metric keep their case
+func (metric *MetricInfo) preserveCase() bool {
+	return nil != metric.PreserveCase && *metric.PreserveCase
+}
+
+// caseOf - the label name or value as exported: trimmed and lowercased by
+// default
+func (metric *MetricInfo) caseOf(str string) string {
+	if metric.preserveCase() {
+		return strings.TrimSpace(str)
+	}
+	return low(str)
+}
 
-	var tenantsOk []TenantInfo
+// Prepare - add missing information to tenant struct - tenants, which can't be
+// connected, are kept and revived during the following scrapes
+func (config *Config) Prepare() ([]TenantInfo, error) {
 
 	// adapt config.Metrics schema filter
 	config.AdaptSchemaFilter()
 
-	secretMap, err := config.GetSecretMap()
+	// metrics without own label prefixes strip the global ones
+	config.InheritStripPrefixes()
+	config.InheritWordSeparator()
+	config.InheritPreserveCase()
+	config.InheritReservedLabels()
+
+	// one tenant per endpoint of the tenant templates
+	err := config.ExpandEndpoints()
 	if err != nil {
-		return nil, errors.Wrap(err, "prepare(getSecretMap)")
+		return nil, errors.Wrap(err, "Prepare(ExpandEndpoints)")
 	}
 
-	for i := 0; i < len(config.Tenants); i++ {
+	// tenants without own tls settings use the global ones
+	config.InheritTLS()
 
-		config.Tenants[i].conn = config.getConnection(i, secretMap)
-		if config.Tenants[i].conn == nil {
-			continue
-		}
+	err = config.ValidateTLS()
+	if err != nil {
+		return nil, errors.Wrap(err, "Prepare(ValidateTLS)")
+	}
+
+	err = config.InheritDecimalSeparator()
+	if err != nil {
+		return nil, errors.Wrap(err, "Prepare(InheritDecimalSeparator)")
+	}
+
+	for i := 0; i < len(config.Tenants); i++ {
 
-		// get tenant usage and hana-user schema information
-		err = config.collectRemainingTenantInfos(i)
+		err := config.ConnectFunc(context.Background(), i)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"tenant": config.Tenants[i].Name,
 				"error":  err,
-			}).Error("Problems with select of remaining tenant info - tenant removed!")
+			}).Error("Can't connect tenant - will be retried at the next scrape!")
 
+			config.setState(i, tenantDown)
 			continue
 		}
-		tenantsOk = append(tenantsOk, config.Tenants[i])
+		config.setState(i, tenantConnected)
+	}
+	return config.Tenants, nil
+}
+
+// RetryConnect - connect the tenants, which are down after the preparation,
+// again with exponential backoff. The waits are limited altogether by the
+// maximum wait, so that the startup finishes in bounded time. Tenants, which
+// are still down, are revived during the following scrapes.
+func (config *Config) RetryConnect() {
+
+	deadline := time.Now().Add(time.Duration(config.RetryMaxWait * float64(time.Second)))
+	interval := time.Duration(config.RetryInterval * float64(time.Second))
+
+	for retry := uint(1); retry <= config.ConnectRetries; retry++ {
+		var down []int
+		for i := range config.Tenants {
+			if config.stateOf(i) == tenantDown {
+				down = append(down, i)
+			}
+		}
+		if len(down) == 0 {
+			return
+		}
+
+		wait := interval
+		if remaining := time.Until(deadline); wait > remaining {
+			wait = remaining
+		}
+		if wait <= 0 {
+			log.WithFields(log.Fields{
+				"tenants": len(down),
+			}).Warn("Maximum wait for connect retries exceeded - tenants will be retried at the next scrape!")
+			return
+		}
+		time.Sleep(wait)
+		interval *= 2
+
+		for _, i := range down {
+			err := config.ConnectFunc(context.Background(), i)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"tenant": config.Tenants[i].Name,
+					"retry":  retry,
+					"error":  err,
+				}).Warn("Connect retry of tenant failed.")
+				continue
+			}
+			log.WithFields(log.Fields{
+				"tenant": config.Tenants[i].Name,
+				"retry":  retry,
+			}).Info("Tenant connected by retry.")
+			config.setState(i, tenantConnected)
+		}
 	}
-	return tenantsOk, nil
+}
 
+// InitContext - context for the setup and discovery queries of a tenant, so
+// that a wedged tenant fails promptly, also cancelled with the parent context
+func (config *Config) InitContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if config.InitTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(config.InitTimeout*float64(time.Second)))
 }
 
-// get tenant usage and hana-user schema information
-func (config *Config) collectRemainingTenantInfos(tPos int) error {
+// CollectRemainingTenantInfos - get tenant usage and hana-user schema information
+func (config *Config) CollectRemainingTenantInfos(parent context.Context, tPos int) error {
+
+	ctx, cancel := config.InitContext(parent)
+	defer cancel()
+
+	// usage and schemas are replaced at the end, as they are read
+	// concurrently by the exporter metrics
+	config.connMu.RLock()
+	conn := config.Tenants[tPos].conn
+	schemas := append([]string(nil), config.Tenants[tPos].Schemas...)
+	config.connMu.RUnlock()
 
-	// get tenant usage information
-	row := config.Tenants[tPos].conn.QueryRow("select usage from sys.m_database")
-	err := row.Scan(&config.Tenants[tPos].Usage)
+	// get tenant usage information - it is only a label, so the tenant is
+	// kept with the default usage, if it can't be selected
+	var usage string
+	row := conn.QueryRowContext(ctx, "select usage from sys.m_database")
+	err := row.Scan(&usage)
 	if err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(Scan)")
+		log.WithFields(log.Fields{
+			"tenant": config.Tenants[tPos].Name,
+			"error":  err,
+		}).Warn("Can't select usage of tenant - default usage is used.")
+		usage = config.DefaultUsage
 	}
+	defer func() {
+		config.connMu.Lock()
+		config.Tenants[tPos].Usage = usage
+		config.Tenants[tPos].Schemas = schemas
+		config.connMu.Unlock()
+	}()
 
 	// append sys schema to tenant schemas
-	config.Tenants[tPos].Schemas = append(config.Tenants[tPos].Schemas, "sys")
+	if !ContainsString("sys", schemas) {
+		schemas = append(schemas, "sys")
+	}
 
 	// append remaining user schema privileges
-	rows, err := config.Tenants[tPos].conn.Query("select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", strings.ToUpper(config.Tenants[tPos].User))
+	rows, err := conn.QueryContext(ctx, "select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", strings.ToUpper(config.Tenants[tPos].User))
 	if err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(Query)")
+		return errors.Wrap(err, "CollectRemainingTenantInfos(Query)")
 	}
 	defer rows.Close()
 
@@ -441,12 +4042,14 @@ func (config *Config) collectRemainingTenantInfos(tPos int) error {
 		var schema string
 		err := rows.Scan(&schema)
 		if err != nil {
-			return errors.Wrap(err, "collectRemainingTenantInfos(Scan)")
+			return errors.Wrap(err, "CollectRemainingTenantInfos(Scan)")
+		}
+		if !ContainsString(schema, schemas) {
+			schemas = append(schemas, schema)
 		}
-		config.Tenants[tPos].Schemas = append(config.Tenants[tPos].Schemas, schema)
 	}
 	if err = rows.Err(); err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(rows.Err)")
+		return errors.Wrap(err, "CollectRemainingTenantInfos(rows.Err)")
 	}
 	return nil
 }
@@ -500,18 +4103,18 @@ func FirstValueInSlice(subSlice []string, slice []string) string {
 // ---------------------------------------------------------------------
 
 // GetTestData1 - for testing purpose only
-func (config *Config) GetTestData1(mPos, tPos int) []MetricRecord {
+func (config *Config) GetTestData1(ctx context.Context, mPos, tPos int) []MetricRecord {
 	mr := []MetricRecord{
 		{
-			999.0,
-			[]string{"l" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
-			[]string{"lv" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
+			Value:       999.0,
+			Labels:      []string{"l" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
+			LabelValues: []string{"lv" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
 		},
 	}
 	return mr
 }
 
 // GetTestData2 - for testing purpose only
-func (config *Config) GetTestData2(mPos, tPos int) []MetricRecord {
+func (config *Config) GetTestData2(ctx context.Context, mPos, tPos int) []MetricRecord {
 	return nil
 }
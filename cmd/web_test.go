@@ -1,11 +1,32 @@
 package cmd_test
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/ulranh/hana_sql_exporter/cmd"
 
 	"github.com/stretchr/testify/assert"
@@ -96,6 +117,2268 @@ func Test_CollectNilMetrics(t *testing.T) {
 	assert.Nil(res)
 }
 
+func Test_MaxScrapeDuration(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 1)
+	config.MaxScrapeDuration = 0.1
+
+	// the second metric hangs
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		if mPos == 1 {
+			time.Sleep(2 * time.Second)
+		}
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	start := time.Now()
+	res := config.CollectMetrics()
+	assert.True(time.Since(start) < time.Second)
+
+	assert.Equal(2, len(res))
+	assert.Equal("m1", res[0].Name)
+	assert.Equal("hana_sql_exporter_scrape_partial", res[1].Name)
+	assert.Equal(1.0, res[1].Stats[0].Value)
+}
+
+func Test_GlobalMetric(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 3)
+	config.Metrics[0].Global = true
+
+	var calls int32
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		if mPos == 0 {
+			atomic.AddInt32(&calls, 1)
+		}
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	// executed once for the first tenant, other metrics for every tenant
+	res := config.CollectMetrics()
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	assert.Equal([]cmd.MetricRecord{{Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}, res[0].Stats)
+	assert.Equal(3, len(res[1].Stats))
+
+	// designated tenant
+	config.Metrics[0].GlobalTenant = "d03"
+	assert.Nil(config.ValidateMetrics())
+	assert.Equal(2, config.GlobalTenant(0, cmd.ScrapeFilter{}))
+	res = config.CollectMetrics()
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+	assert.Equal([]string{"lv02"}, res[0].Stats[0].LabelValues)
+
+	config.Metrics[0].GlobalTenant = "d09"
+	assert.NotNil(config.ValidateMetrics())
+	assert.Equal(0, config.GlobalTenant(0, cmd.ScrapeFilter{}))
+}
+
+func Test_TenantConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+
+	var running, max int32
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		cur := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&max)
+			if cur <= old || atomic.CompareAndSwapInt32(&max, old, cur) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	// without limit all tenants are queried in parallel
+	res := config.CollectMetrics()
+	assert.Equal(3, len(res[0].Stats))
+	assert.Equal(int32(3), atomic.LoadInt32(&max))
+
+	// limited
+	atomic.StoreInt32(&max, 0)
+	config.TenantConcurrency = 1
+	res = config.CollectMetrics()
+	assert.Equal(3, len(res[0].Stats))
+	assert.Equal(int32(1), atomic.LoadInt32(&max))
+}
+
+func Test_QueryConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	var running, max int32
+	collect := func(limit uint) []cmd.MetricData {
+		config := getTestConfig(2, 3)
+		config.QueryConcurrency = limit
+		config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+			cur := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&max)
+				if cur <= old || atomic.CompareAndSwapInt32(&max, old, cur) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return config.GetTestData1(ctx, mPos, tPos)
+		}
+		atomic.StoreInt32(&max, 0)
+		return config.CollectMetrics()
+	}
+
+	// without limit all metrics and tenants are queried in parallel
+	res := collect(0)
+	assert.Equal(3, len(res[0].Stats))
+	assert.Equal(int32(6), atomic.LoadInt32(&max))
+
+	// the limit is shared by the metrics, the other queries wait
+	res = collect(2)
+	assert.Equal(3, len(res[0].Stats))
+	assert.Equal(3, len(res[1].Stats))
+	assert.Equal(int32(2), atomic.LoadInt32(&max))
+}
+
+func Test_MetricTimeout(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 1)
+	config.DataFunc = config.GetMetricData
+	config.SetConnections(0, openNamedMockDB(t, "metrictimeout"), nil)
+	slow := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockResult("metrictimeout", slow, []string{"count"}, []driver.Value{int64(1)})
+	setMockDelay("metrictimeout:"+slow, 500*time.Millisecond)
+	setNamedMockResult("metrictimeout", "select allocated_size,port from sys.m_rs_memory where category='TABLE'", []string{"allocated_size", "port"},
+		[]driver.Value{int64(10), "30003"},
+	)
+
+	// only the metric with the exceeded own timeout is dropped
+	config.Metrics[0].Timeout = 0.05
+	assert.Nil(config.ValidateMetrics())
+	start := time.Now()
+	res := config.CollectMetrics()
+	assert.True(time.Since(start) < 400*time.Millisecond)
+	assert.Equal(1, len(res))
+	assert.Equal("m2", res[0].Name)
+	assert.Equal(1, len(res[0].Stats))
+	stats := config.ErrorCountMetrics().Stats
+	assert.Equal(1, len(stats))
+	assert.Equal([]string{"m1", "d01", "metric_timeout"}, stats[0].LabelValues)
+
+	// timeouts don't reconnect the tenant
+	assert.False(cmd.ConnectionError(context.DeadlineExceeded))
+
+	config.Metrics[0].Timeout = -1
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_Watchdog(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+	config.Timeout = 1
+	config.TimeoutBuffer = 0.95
+	config.WatchdogTimeout = 0.2
+	assert.Equal(200*time.Millisecond, config.WatchdogLimit(cmd.ScrapeFilter{}))
+
+	// the limit is at least twice the scrape timeout
+	assert.Equal(18100*time.Millisecond, config.WatchdogLimit(cmd.ScrapeFilter{Timeout: 10}))
+
+	// normal collections are not affected
+	res := config.CollectMetrics()
+	assert.Equal("m1", res[0].Name)
+
+	// stuck ping of the tenant connection
+	config.ConnectFunc = func(ctx context.Context, tPos int) error { return nil }
+	config.SetConnections(0, openNamedMockDB(t, "watchdog"), nil)
+	setMockStuck("watchdog:ping", time.Second)
+
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	start := time.Now()
+	res = config.CollectMetrics()
+	log.SetOutput(os.Stderr)
+
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(1, len(res))
+	assert.Equal("hana_sql_exporter_scrape_stalled", res[0].Name)
+	assert.Contains(buf.String(), "goroutine")
+
+	// no second collection runs alongside the cancelled one
+	assert.True(config.Stalled())
+	res = config.CollectMetrics()
+	assert.Equal("hana_sql_exporter_scrape_stalled", res[0].Name)
+
+	// collections start again, after the cancelled one has returned
+	for i := 0; i < 200 && config.Stalled(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(config.Stalled())
+	setMockDelay("watchdog:ping", 0)
+	res = config.CollectMetrics()
+	assert.Equal("m1", res[0].Name)
+}
+
+func Test_ReconnectTenantState(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+
+	// the background reconnect sets the tenant state, while the exporter
+	// metrics of the next scrapes read it
+	config.ConnectFunc = func(ctx context.Context, tPos int) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	assert.Nil(config.CollectMetrics())
+	for i := 0; i < 200 && config.ExporterMetrics()[0].Stats[0].Value == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(1.0, config.ExporterMetrics()[0].Stats[0].Value)
+	config.WaitReconnects()
+}
+
+func Test_MaxScrapeDurationReconnect(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+	config.MaxScrapeDuration = 0.1
+
+	// the hung reconnect of the tenant runs in the background, the tenant is
+	// skipped meanwhile
+	release := make(chan struct{})
+	config.ConnectFunc = func(ctx context.Context, tPos int) error {
+		<-release
+		config.SetConnections(tPos, openNamedMockDB(t, "ceiling"), nil)
+		return nil
+	}
+	start := time.Now()
+	assert.Nil(config.CollectMetrics())
+	assert.True(time.Since(start) < time.Second)
+
+	// no second reconnect is started by the next scrape
+	assert.Nil(config.CollectMetrics())
+	close(release)
+	config.WaitReconnects()
+	res := config.CollectMetrics()
+	assert.Equal("m1", res[0].Name)
+}
+
+func Test_MaxScrapeDurationSenders(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(4, 3)
+	config.MaxScrapeDuration = 0.05
+
+	// data functions ignoring the context answer after the reader returned
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		time.Sleep(200 * time.Millisecond)
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		res := config.CollectMetrics()
+		assert.Equal(1, len(res))
+		assert.Equal("hana_sql_exporter_scrape_partial", res[0].Name)
+	}
+
+	// all pending senders return after their late answer
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(runtime.NumGoroutine() <= before)
+}
+
+func Test_GuardedMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+
+	var calls int32
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		atomic.AddInt32(&calls, 1)
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	// without guard every scrape queries the tenants
+	config.GuardedMetrics()
+	config.GuardedMetrics()
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	// rapid scrapes get the cached result
+	config.MinInterval = 60
+	res1 := config.GuardedMetrics()
+	res2 := config.GuardedMetrics()
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(res1, res2)
+}
+
+func Test_HanaUpMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		if tPos == 1 {
+			config.RecordError(config.Metrics[mPos].Name, config.Tenants[tPos].Name, errors.New("query failed"))
+			return nil
+		}
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	// d02 fails
+	config.CollectMetrics()
+	up := config.HanaUpMetrics()
+	assert.Equal("hana_up", up.Name)
+	assert.Equal([]float64{1, 0, 1}, []float64{up.Stats[0].Value, up.Stats[1].Value, up.Stats[2].Value})
+	assert.Equal([]string{"tenant", "usage"}, up.Stats[1].Labels)
+
+	// recovered in the next collection
+	config.DataFunc = config.GetTestData1
+	config.CollectMetrics()
+	assert.Equal(1.0, config.HanaUpMetrics().Stats[1].Value)
+}
+
+func Test_ErrorCountMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "errors"), nil)
+	query := "select count(*) from sys.m_blocked_transactions"
+
+	counts := func() map[string]float64 {
+		res := make(map[string]float64)
+		for _, record := range config.ErrorCountMetrics().Stats {
+			res[strings.Join(record.LabelValues, ",")] = record.Value
+		}
+		return res
+	}
+
+	// query error, twice
+	setNamedMockError("errors", query, errors.New("connection reset"))
+	config.GetMetricData(context.Background(), 0, 0)
+	config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(2.0, counts()["m1,d01,query"])
+
+	// non-numeric value column and other read errors
+	setNamedMockResult("errors", query, []string{"host"}, []driver.Value{"hana1"})
+	config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1.0, counts()["m1,d01,value_column"])
+
+	// schema filter miss
+	config.Metrics[0].SchemaFilter = []string{"sapabap1"}
+	config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1.0, counts()["m1,d01,schema_filter"])
+
+	// invalid values
+	config.Metrics[0].SchemaFilter = []string{"sys"}
+	config.Metrics[0].InvalidValues = "drop"
+	setNamedMockResult("errors", query, []string{"count"}, []driver.Value{math.NaN()})
+	config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1.0, counts()["m1,d01,invalid_value"])
+
+	// missing object, the metric is skipped afterwards
+	setNamedMockError("errors", query, errors.New("invalid table name: Could not find table/view M_BLOCKED_TRANSACTIONS"))
+	config.GetMetricData(context.Background(), 0, 0)
+	config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1.0, counts()["m1,d01,object_not_found"])
+
+	// exported as counter
+	md := config.ErrorCountMetrics()
+	assert.Equal("hana_scrape_errors_total", md.Name)
+	assert.Equal("counter", md.MetricType)
+	assert.Equal([]string{"metric", "tenant", "reason"}, md.Stats[0].Labels)
+	assert.Equal(2.0, counts()["m1,d01,query"])
+}
+
+func Test_ScrapeDurationMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "duration"), nil)
+	query := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockResult("duration", query, []string{"count"}, []driver.Value{int64(1)})
+	setMockDelay("duration:"+query, 100*time.Millisecond)
+
+	// the channel plumbing of the collection is not measured
+	assert.Equal(0, len(config.ScrapeDurationMetrics().Stats))
+	config.GetMetricData(context.Background(), 0, 0)
+
+	md := config.ScrapeDurationMetrics()
+	assert.Equal("hana_scrape_duration_seconds", md.Name)
+	assert.Equal([]string{"m1", "d01"}, md.Stats[0].LabelValues)
+	assert.True(md.Stats[0].Value >= 0.1)
+	assert.True(md.Stats[0].Value < 1)
+}
+
+func Test_GoroutineMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+	config.Timeout = 1
+	release := make(chan struct{})
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		if 1 == tPos {
+			<-release
+		}
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+
+	md := config.GoroutineMetrics()
+	assert.Equal("hana_sql_exporter_active_collection_goroutines", md.Name)
+	assert.Equal(0.0, md.Stats[0].Value)
+
+	// the goroutine of the hanging tenant is still running after the timeout
+	config.CollectMetric(context.Background(), 0, cmd.ScrapeFilter{})
+	assert.Equal(1.0, config.GoroutineMetrics().Stats[0].Value)
+
+	// and returns to the baseline, once the query returns
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for config.GoroutineMetrics().Stats[0].Value != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(0.0, config.GoroutineMetrics().Stats[0].Value)
+}
+
+func Test_CacheAgeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 2)
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return config.AddOrigin(mPos, tPos, config.GetTestData1(ctx, mPos, tPos))
+	}
+
+	// only with minimum interval
+	config.GuardedMetrics()
+	age := config.ExporterMetrics()[6]
+	assert.Equal("hana_sql_exporter_cache_age_seconds", age.Name)
+	assert.Equal(0, len(age.Stats))
+
+	config.MinInterval = 60
+	config.GuardedMetrics()
+	time.Sleep(100 * time.Millisecond)
+
+	// the cached values get older with every scrape
+	config.GuardedMetrics()
+	age = config.ExporterMetrics()[6]
+	assert.Equal(4, len(age.Stats))
+	var keys []string
+	for _, record := range age.Stats {
+		keys = append(keys, strings.Join(record.LabelValues, ","))
+		assert.True(record.Value >= 0.1)
+		assert.True(record.Value < 1)
+	}
+	assert.Contains(keys, "m1,d01")
+	assert.Contains(keys, "m2,d02")
+}
+
+func Test_ActivationListener(t *testing.T) {
+	assert := assert.New(t)
+
+	// not socket activated
+	listener, err := cmd.ActivationListener(func(string) string { return "" }, 3)
+	assert.NoError(err)
+	assert.Nil(listener)
+
+	// listener passed by systemd
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer passed.Close()
+	f, err := passed.(*net.TCPListener).File()
+	assert.NoError(err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	assert.NoError(err)
+	f.Close()
+
+	env := map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "1",
+	}
+	listener, err = cmd.ActivationListener(func(key string) string { return env[key] }, uintptr(fd))
+	assert.NoError(err)
+	defer listener.Close()
+	assert.Equal(passed.Addr().String(), listener.Addr().String())
+
+	go http.Serve(listener, http.HandlerFunc(cmd.RootHandler))
+	resp, err := http.Get("http://" + listener.Addr().String())
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// variables of another process
+	env["LISTEN_PID"] = "1"
+	listener, err = cmd.ActivationListener(func(key string) string { return env[key] }, uintptr(fd))
+	assert.NoError(err)
+	assert.Nil(listener)
+}
+
+func Test_Shutdown(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	db := openNamedMockDB(t, "shutdown")
+	config.SetConnections(0, db, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "scraped")
+	})}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	// the running scrape is finished before the connections are closed
+	scraped := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			scraped <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		scraped <- string(body)
+	}()
+	<-started
+
+	sig := make(chan os.Signal, 1)
+	sig <- syscall.SIGTERM
+	assert.NoError(config.Shutdown(server, sig, 2*time.Second))
+	assert.Equal("scraped", <-scraped)
+	assert.Equal(http.ErrServerClosed, <-served)
+	assert.Error(db.Ping())
+}
+
+// slowWriter - response writer of a slow connection
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (sw *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(sw.delay)
+	return sw.ResponseRecorder.Write(b)
+}
+
+func Test_DeadlineHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 500; i++ {
+		reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "large_payload_" + strconv.Itoa(i),
+			Help: "Part of a large payload.",
+		}))
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+
+	// without budget all families are written
+	rec := httptest.NewRecorder()
+	cmd.DeadlineHandler(reg, 0).ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(500, strings.Count(rec.Body.String(), "# TYPE "))
+	assert.NotContains(rec.Body.String(), "hana_sql_exporter_scrape_truncated")
+	assert.Equal(string(expfmt.Negotiate(req.Header)), rec.Header().Get("Content-Type"))
+	assert.Equal([]string{"Accept", "Accept-Encoding"}, rec.Header()["Vary"])
+
+	// short budget on a slow connection
+	sw := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: time.Millisecond}
+	cmd.DeadlineHandler(reg, 100*time.Millisecond).ServeHTTP(sw, req)
+	body := sw.Body.String()
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	assert.True(len(lines) >= 3)
+
+	written := strings.Count(body, "# TYPE ") - 1
+	assert.True(written > 0 && written < 500)
+	assert.Equal("hana_sql_exporter_scrape_truncated "+strconv.Itoa(500-written), lines[len(lines)-1])
+
+	// the written families are complete
+	assert.Equal(written, strings.Count(body, "# HELP large_payload_"))
+	assert.Equal(written, strings.Count(body, "\nlarge_payload_"))
+
+	// gather errors fail the request and are counted like in promhttp
+	gatherErrors := func() float64 {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		assert.Nil(err)
+		for _, mf := range mfs {
+			if "promhttp_metric_handler_errors_total" != mf.GetName() {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if "gathering" == m.GetLabel()[0].GetValue() {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+	before := gatherErrors()
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, _ := reg.Gather()
+		return mfs, errors.New("duplicate metric")
+	})
+	rec = httptest.NewRecorder()
+	cmd.DeadlineHandler(failing, 0).ServeHTTP(rec, req)
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+	assert.Contains(rec.Body.String(), "duplicate metric")
+	assert.Equal(before+1, gatherErrors())
+}
+
+func Test_AddSourceLabel(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+	config.SourceLabel = true
+	config.MinInterval = 60
+
+	// first scrape is collected live
+	res := config.GuardedMetrics()
+	assert.Equal([]string{"l00", "source"}, res[0].Stats[0].Labels)
+	assert.Equal([]string{"lv00", "live"}, res[0].Stats[0].LabelValues)
+
+	// rapid scrapes get the cache without a second source label
+	for i := 0; i < 2; i++ {
+		res = config.GuardedMetrics()
+		assert.Equal([]string{"l00", "source"}, res[0].Stats[0].Labels)
+		assert.Equal([]string{"lv00", "cache"}, res[0].Stats[0].LabelValues)
+	}
+
+	// disabled label
+	config.SourceLabel = false
+	res = config.GuardedMetrics()
+	assert.Equal([]string{"l00"}, res[0].Stats[0].Labels)
+
+	// a column source doesn't duplicate the label
+	config.SourceLabel = true
+	config.InheritReservedLabels()
+	db := openMockDB(t)
+	setMockResult("select cnt, source from sourced", []string{"CNT", "SOURCE"}, []driver.Value{int64(1), "a"})
+	rows, err := db.Query("select cnt, source from sourced")
+	assert.NoError(err)
+	_, err = config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.Error(err)
+
+	// records with the label keep it once
+	md := []cmd.MetricData{{Name: "m1", Stats: []cmd.MetricRecord{{Labels: []string{"source"}, LabelValues: []string{"a"}}}}}
+	res = config.AddSourceLabel(md, "live")
+	assert.Equal([]string{"source"}, res[0].Stats[0].Labels)
+	assert.Equal([]string{"a"}, res[0].Stats[0].LabelValues)
+}
+
+func Test_AddTagsLabel(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+
+	// joined tags as label
+	md := config.AddTagsLabel(2, config.GetTestData1(context.Background(), 0, 2))
+	assert.Equal([]string{"l02", "tags"}, md[0].Labels)
+	assert.Equal([]string{"lv02", "bw"}, md[0].LabelValues)
+
+	// tenant without tags gets an empty label value
+	md = config.AddTagsLabel(0, config.GetTestData1(context.Background(), 0, 0))
+	assert.Equal([]string{"l00", "tags"}, md[0].Labels)
+	assert.Equal([]string{"lv00", ""}, md[0].LabelValues)
+
+	// too long tags are rejected for all tenants at the start
+	config.Tenants[1].Tags = []string{strings.Repeat("x", 300)}
+	assert.NoError(config.ValidateMetrics())
+	config.TagsLabel = true
+	assert.Error(config.ValidateMetrics())
+
+	// a column tags doesn't duplicate the label
+	config.Tenants[1].Tags = []string{"erp"}
+	config.InheritReservedLabels()
+	db := openMockDB(t)
+	setMockResult("select cnt, tags from tagged", []string{"CNT", "TAGS"}, []driver.Value{int64(1), "a"})
+	rows, err := db.Query("select cnt, tags from tagged")
+	assert.NoError(err)
+	_, err = config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.Error(err)
+}
+
+func Test_MetricsHandler(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 3)
+
+	serve := func() int {
+		handler := config.MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config.GuardedMetrics()
+			fmt.Fprint(w, "metrics")
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Code
+	}
+
+	// default status, even if nothing was collected
+	config.DataFunc = config.GetTestData2
+	assert.Equal(http.StatusOK, serve())
+
+	// fail status, if nothing was collected
+	config.FailStatus = http.StatusInternalServerError
+	assert.Equal(http.StatusInternalServerError, serve())
+
+	// normal status with collected metrics
+	config.DataFunc = config.GetTestData1
+	assert.Equal(http.StatusOK, serve())
+
+	// the marker of a partial collection doesn't count
+	config.MaxScrapeDuration = 0.05
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		<-ctx.Done()
+		return nil
+	}
+	assert.Equal(http.StatusInternalServerError, serve())
+
+	// flushes are forwarded with the fail status
+	handler := config.MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(rec.Flushed)
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+}
+
+func Test_FilterHandler(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 3)
+	config.Tenants[1].Tags = []string{"env:prod", "abap"}
+	config.DataFunc = config.GetTestData1
+
+	handler := config.FilterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "unfiltered")
+	}))
+	scrape := func(url string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	// without filter the request is passed through
+	assert.Equal("unfiltered", scrape("/metrics"))
+
+	// filter by metric name
+	out := scrape("/metrics?metric=m2")
+	assert.Equal(3, strings.Count(out, "\nm2{"))
+	assert.NotContains(out, "m1{")
+
+	// filter by tenant tag
+	out = scrape("/metrics?tag=env:prod")
+	assert.Contains(out, `m1{l01="lv01"} 999`)
+	assert.Contains(out, `m2{l11="lv11"} 999`)
+	assert.NotContains(out, "lv00")
+	assert.NotContains(out, "lv02")
+
+	// both filters
+	out = scrape("/metrics?metric=m1,m3&tag=env:prod")
+	assert.Contains(out, `m1{l01="lv01"} 999`)
+	assert.NotContains(out, "m2{")
+}
+
+func Test_ValidateGroups(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+
+	config.Groups = []cmd.GroupInfo{{Name: "erp"}, {Name: "BW-prod_2"}}
+	assert.NoError(config.ValidateMetrics())
+
+	// names, which would break or collide in the endpoint paths
+	for _, names := range [][]string{{""}, {"erp", "ERP"}, {"e r p"}, {"erp/prod"}, {"erp", "erp"}} {
+		config.Groups = nil
+		for _, name := range names {
+			config.Groups = append(config.Groups, cmd.GroupInfo{Name: name})
+		}
+		assert.Error(config.ValidateMetrics(), names)
+	}
+}
+
+func Test_GroupHandler(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+	config.Tenants[0].Group = "a"
+	config.Tenants[1].Group = "b"
+	config.Tenants[2].Group = "A"
+	config.DataFunc = config.GetTestData1
+
+	scrape := func(group cmd.GroupInfo) string {
+		rec := httptest.NewRecorder()
+		config.GroupHandler(group).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/"+group.Name, nil))
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	out := scrape(cmd.GroupInfo{Name: "a"})
+	assert.Contains(out, `m1{l00="lv00"} 999`)
+	assert.Contains(out, `m1{l02="lv02"} 999`)
+	assert.NotContains(out, "lv01")
+
+	out = scrape(cmd.GroupInfo{Name: "b", Timeout: 10})
+	assert.Contains(out, `m1{l01="lv01"} 999`)
+	assert.NotContains(out, "lv00")
+	assert.NotContains(out, "lv02")
+
+	// the fail status depends on the collection of the group
+	config.FailStatus = http.StatusServiceUnavailable
+	scrape(cmd.GroupInfo{Name: "a"})
+	config.DataFunc = config.GetTestData2
+	rec := httptest.NewRecorder()
+	config.GroupHandler(cmd.GroupInfo{Name: "a"}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/a", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+}
+
+func Test_ReadyHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	// collections without data don't make the exporter ready
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData2
+	config.CollectMetrics()
+	assert.False(config.Ready())
+
+	config = getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		config.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+
+	// not ready before the first collection, which is started in the background
+	assert.Equal(http.StatusServiceUnavailable, ready())
+	deadline := time.Now().Add(2 * time.Second)
+	for !config.Ready() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(http.StatusOK, ready())
+
+	// frequent probes of a not ready exporter start only one collection
+	var collections int32
+	config = getTestConfig(1, 1)
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		atomic.AddInt32(&collections, 1)
+		return nil
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(http.StatusServiceUnavailable, ready())
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&collections))
+}
+
+func Test_HealthzReadyz(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 2)
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		config.ReadyzHandler(100*time.Millisecond).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	cmd.HealthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// not ready without connections
+	assert.Equal(http.StatusServiceUnavailable, readyz())
+
+	// a hung tenant doesn't block the probe
+	config.SetConnections(0, openNamedMockDB(t, "readyz-hung"), nil)
+	setMockDelay("readyz-hung:ping", 5*time.Second)
+	start := time.Now()
+	assert.Equal(http.StatusServiceUnavailable, readyz())
+	assert.True(time.Since(start) < time.Second)
+
+	// one answering tenant is enough
+	config.SetConnections(1, openNamedMockDB(t, "readyz"), nil)
+	assert.Equal(http.StatusOK, readyz())
+}
+
+func Test_ReadyzReconnect(t *testing.T) {
+	assert := assert.New(t)
+	config := getMockConfig(t, 1, 1)
+
+	var err error
+	config.Tenants, err = config.Prepare()
+	assert.NoError(err)
+
+	// the probe reads the connections, while reconnects and reloads replace them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			config.PingTenants(context.Background())
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		assert.NoError(config.ConnectTenant(context.Background(), 0))
+		assert.NoError(config.Reload(getMockConfig(t, 1, 1)))
+	}
+	<-done
+	assert.True(config.PingTenants(context.Background()))
+}
+
+func Test_RecentErrors(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.ErrorBuffer = 2
+	config.SetConnections(0, openNamedMockDB(t, "errors"), nil)
+
+	setNamedMockError("errors", "select count(*) from sys.m_blocked_transactions", errors.New("insufficient privilege"))
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	errs := config.RecentErrors()
+	assert.Equal(1, len(errs))
+	assert.Equal("m1", errs[0].Metric)
+	assert.Equal("d01", errs[0].Tenant)
+	assert.Equal("insufficient privilege", errs[0].Message)
+
+	// only the most recent errors are kept
+	config.RecordError("m2", "d01", errors.New("e2"))
+	config.RecordError("m3", "d01", errors.New("e3"))
+	errs = config.RecentErrors()
+	assert.Equal(2, len(errs))
+	assert.Equal("e2", errs[0].Message)
+	assert.Equal("e3", errs[1].Message)
+
+	// endpoint with token
+	config.DebugToken = "secret"
+	rec := httptest.NewRecorder()
+	config.ErrorsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/errors", nil))
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/errors", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	config.ErrorsHandler().ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"metric":"m3","message":"e3"`)
+
+	// prefixes and extensions of the token are rejected
+	for _, auth := range []string{"Bearer secre", "Bearer secret2", "secret"} {
+		rec = httptest.NewRecorder()
+		req.Header.Set("Authorization", auth)
+		config.ErrorsHandler().ServeHTTP(rec, req)
+		assert.Equal(http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func Test_Descriptors(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 2)
+
+	// one descriptor per configured metric
+	descriptors := config.Descriptors()
+	assert.Equal(len(config.Metrics), len(descriptors))
+	for i, metric := range config.Metrics {
+		assert.Equal(metric.Name, descriptors[i].Name)
+		assert.Equal(metric.Help, descriptors[i].Help)
+		assert.Equal(metric.MetricType, descriptors[i].Type)
+		assert.Equal([]string{"tenant", "usage"}, descriptors[i].Labels)
+	}
+
+	// label columns, value columns, tenant prefixes and exporter labels
+	config.Metrics = config.Metrics[:1]
+	config.Metrics[0].LabelColumns = []string{"HOST_NAME", "port", "used_memory"}
+	config.Metrics[0].DropColumns = []string{"port"}
+	config.Metrics[0].StripPrefixes = []string{"host_"}
+	config.Metrics[0].ValueColumns = []string{"used_memory", "free_memory"}
+	config.Tenants[1].MetricPrefix = "q01"
+	config.TagsLabel = true
+	assert.Equal([]cmd.MetricDescriptor{
+		{Name: "m1_used_memory", Help: "h1", Type: "gauge", Labels: []string{"tenant", "usage", "name", "tags"}},
+		{Name: "m1_free_memory", Help: "h1", Type: "gauge", Labels: []string{"tenant", "usage", "name", "tags"}},
+		{Name: "q01_m1_used_memory", Help: "h1", Type: "gauge", Labels: []string{"tenant", "usage", "name", "tags"}},
+		{Name: "q01_m1_free_memory", Help: "h1", Type: "gauge", Labels: []string{"tenant", "usage", "name", "tags"}},
+	}, config.Descriptors())
+
+	// endpoint
+	rec := httptest.NewRecorder()
+	config.DescriptorsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/descriptors", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+	assert.Contains(rec.Body.String(), `{"name":"q01_m1_free_memory","help":"h1","type":"gauge","labels":["tenant","usage","name","tags"]}`)
+}
+
+func Test_LastErrorMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "lasterror"), nil)
+	assert.Nil(config.LastErrorMetrics().Stats)
+
+	setNamedMockError("lasterror", "select count(*) from sys.m_blocked_transactions", errors.New("insufficient privilege"))
+	before := float64(time.Now().Unix())
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	md := config.LastErrorMetrics()
+	assert.Equal("hana_sql_exporter_last_error_timestamp_seconds", md.Name)
+	assert.Equal(1, len(md.Stats))
+	assert.Equal([]string{"m1", "d01"}, md.Stats[0].LabelValues)
+	assert.True(md.Stats[0].Value >= before)
+
+	// the next failure updates the time
+	first := md.Stats[0].Value
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	md = config.LastErrorMetrics()
+	assert.Equal(1, len(md.Stats))
+	assert.True(md.Stats[0].Value > first)
+}
+
+// hana error with code
+type codeError struct {
+	code int
+}
+
+func (e codeError) Error() string {
+	return fmt.Sprintf("SQL Error %d", e.code)
+}
+
+func (e codeError) Code() int {
+	return e.code
+}
+
+func Test_ObjectNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(cmd.ObjectNotFound(codeError{259}))
+	assert.True(cmd.ObjectNotFound(fmt.Errorf("query: %w", codeError{260})))
+	assert.False(cmd.ObjectNotFound(codeError{258}))
+	assert.True(cmd.ObjectNotFound(errors.New("invalid table name: Could not find table/view M_FOO")))
+	assert.False(cmd.ObjectNotFound(errors.New("connection refused")))
+}
+
+func Test_MetricUnavailable(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "unavailable"), nil)
+
+	sel := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockError("unavailable", sel, codeError{259})
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	assert.True(config.MetricUnavailable(0, 0))
+
+	md := config.UnavailableMetrics()
+	assert.Equal([]cmd.MetricRecord{{Value: 1, Labels: []string{"metric", "tenant"}, LabelValues: []string{"m1", "d01"}}}, md.Stats)
+
+	// the metric is not queried anymore
+	setNamedMockResult("unavailable", sel, []string{"count"}, []driver.Value{int64(1)})
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// other errors don't disable the metric
+	config = getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "available"), nil)
+	setNamedMockError("available", sel, errors.New("connection reset"))
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	assert.False(config.MetricUnavailable(0, 0))
+}
+
+func Test_ScrapeTimeout(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(0, 0)
+
+	// no buffer
+	assert.Equal(3*time.Second, config.ScrapeTimeout())
+
+	// buffer is subtracted
+	config.TimeoutBuffer = 0.5
+	assert.Equal(2500*time.Millisecond, config.ScrapeTimeout())
+
+	// buffer exceeding the timeout is ignored
+	config.TimeoutBuffer = 5
+	assert.Equal(3*time.Second, config.ScrapeTimeout())
+
+	// filters can have their own timeout
+	config.TimeoutBuffer = 0.5
+	assert.Equal(2500*time.Millisecond, config.FilterTimeout(cmd.ScrapeFilter{}))
+	assert.Equal(9500*time.Millisecond, config.FilterTimeout(cmd.ScrapeFilter{Timeout: 10}))
+}
+
+func Test_HeaderTimeout(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	request := func(header string) *http.Request {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if "" != header {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		}
+		return r
+	}
+
+	// missing or malformed headers fall back to the timeout flag
+	assert.Equal(4500*time.Millisecond, config.HeaderTimeout(request("4.5")))
+	for _, header := range []string{"", "abc", "-1", "0", "NaN"} {
+		assert.Equal(time.Duration(0), config.HeaderTimeout(request(header)))
+	}
+	assert.Equal(1500*time.Millisecond, config.FilterTimeout(cmd.ScrapeFilter{Timeout: 10, Deadline: 1500 * time.Millisecond}))
+
+	// the header timeout is used by the collection of the request
+	var remaining time.Duration
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		deadline, _ := ctx.Deadline()
+		remaining = time.Until(deadline)
+		return config.GetTestData1(ctx, mPos, tPos)
+	}
+	handler := config.FilterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config.GuardedMetrics()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), request("1.5"))
+	assert.True(remaining > time.Second && remaining <= 1500*time.Millisecond)
+
+	handler.ServeHTTP(httptest.NewRecorder(), request(""))
+	assert.True(remaining > 2*time.Second && remaining <= 3*time.Second)
+
+	config.Tenants[0].Group = "a"
+	config.GroupHandler(cmd.GroupInfo{Name: "a", Timeout: 10}).ServeHTTP(httptest.NewRecorder(), request("1.5"))
+	assert.True(remaining <= 1500*time.Millisecond)
+}
+
+func Test_WriteMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+
+	var buf strings.Builder
+	err := config.WriteMetrics(&buf)
+	assert.NoError(err)
+
+	out := buf.String()
+	assert.Contains(out, "# HELP m1 h1")
+	assert.Contains(out, "# TYPE m1 gauge")
+	assert.Contains(out, `m1{l00="lv00"} 999`)
+	assert.Contains(out, `hana_sql_exporter_tenant_up{tenant="d01"} 1`)
+}
+
+func Test_SampleLimit(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 3)
+	config.DataFunc = config.GetTestData1
+	config.Metrics[0].SampleLimit = 2
+
+	var buf strings.Builder
+	err := config.WriteMetrics(&buf)
+	assert.NoError(err)
+
+	// three tenants deliver one sample each, but only two are emitted
+	out := buf.String()
+	assert.Equal(2, strings.Count(out, "\nm1{"))
+	assert.Contains(out, `hana_sql_exporter_sample_limit_hits_total{metric="m1"} 1`)
+}
+
+func Test_LogSink(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 1)
+	config.DataFunc = config.GetTestData1
+	config.LogFilter = []string{"m2"}
+
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// every tick writes the selected metric to the log
+	tick := make(chan time.Time, 3)
+	for i := 0; i < 3; i++ {
+		tick <- time.Now()
+	}
+	close(tick)
+	config.LogSink(tick)
+
+	out := buf.String()
+	assert.Equal(3, strings.Count(out, "metric=m2"))
+	assert.Equal(0, strings.Count(out, "metric=m1"))
+	assert.Contains(out, "l10=lv10")
+
+	// records with metric prefix are selected by their own name
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return []cmd.MetricRecord{{Value: 1, Labels: []string{"tenant"}, LabelValues: []string{"d01"}, Prefix: "p01"}}
+	}
+	config.LogFilter = []string{"p01_m2"}
+	buf.Reset()
+	tick = make(chan time.Time, 1)
+	tick <- time.Now()
+	close(tick)
+	config.LogSink(tick)
+	out = buf.String()
+	assert.Equal(1, strings.Count(out, "metric=p01_m2"))
+	assert.Equal(0, strings.Count(out, "metric=p01_m1"))
+}
+
+func Test_TenantSchemas(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(0, 2)
+	config.Tenants[1].Schemas = []string{"sys", "sapabap1", "sapewm"}
+
+	schemas := config.ExporterMetrics()[2]
+	assert.Equal("hana_sql_exporter_tenant_schemas", schemas.Name)
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 1, Labels: []string{"tenant"}, LabelValues: []string{"d01"}},
+		{Value: 3, Labels: []string{"tenant"}, LabelValues: []string{"d02"}},
+	}, schemas.Stats)
+}
+
+func Test_InstanceLabel(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+
+	// disabled by default
+	var buf strings.Builder
+	assert.NoError(config.ResolveInstance())
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.NotContains(buf.String(), "instance=")
+
+	// configured value
+	config.InstanceLabel = true
+	config.Instance = "exporter1"
+	assert.NoError(config.ResolveInstance())
+	buf.Reset()
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.Contains(buf.String(), `m1{instance="exporter1",l00="lv00"} 999`)
+	assert.Contains(buf.String(), `hana_sql_exporter_scraped_series{instance="exporter1"}`)
+
+	// records with own instance label keep it
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return []cmd.MetricRecord{{Value: 1, Labels: []string{"instance"}, LabelValues: []string{"hana1"}}}
+	}
+	buf.Reset()
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.Contains(buf.String(), `m1{instance="hana1"} 1`)
+
+	// hostname as default
+	hostname, err := os.Hostname()
+	assert.NoError(err)
+	config.Instance = ""
+	assert.NoError(config.ResolveInstance())
+	assert.Equal(hostname, config.Instance)
+
+	// invalid values
+	config.Instance = strings.Repeat("x", 300)
+	assert.Error(config.ResolveInstance())
+	config.Instance = "\xff"
+	assert.Error(config.ResolveInstance())
+}
+
+func Test_ScrapedSeries(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 3)
+	config.DataFunc = config.GetTestData1
+
+	var buf strings.Builder
+	err := config.WriteMetrics(&buf)
+	assert.NoError(err)
+
+	// all series except the comments and the count itself
+	var series int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "hana_sql_exporter_scraped_series") {
+			series++
+		}
+	}
+	assert.Equal(20, series)
+	assert.Contains(buf.String(), "\nhana_sql_exporter_scraped_series 20\n")
+}
+
+func Test_MetricPrefix(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 2)
+	config.Tenants[0].MetricPrefix = "p01"
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return config.AddPrefix(tPos, config.GetTestData1(ctx, mPos, tPos))
+	}
+	assert.Nil(config.ValidateMetrics())
+
+	var buf strings.Builder
+	err := config.WriteMetrics(&buf)
+	assert.NoError(err)
+	assert.Contains(buf.String(), `p01_m1{l00="lv00"} 999`)
+	assert.Contains(buf.String(), "\n"+`m1{l01="lv01"} 999`)
+
+	// all tenants without alias get their name as prefix
+	config.TenantPrefix = true
+	assert.Equal("p01", config.MetricPrefix(0))
+	assert.Equal("d02", config.MetricPrefix(1))
+
+	// the combined names are validated
+	config.Tenants[0].MetricPrefix = "p-01"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_RenderHelp(t *testing.T) {
+	assert := assert.New(t)
+
+	help, err := cmd.RenderHelp("Plain help", cmd.HelpData{Tenant: "d01"})
+	assert.NoError(err)
+	assert.Equal("Plain help", help)
+
+	help, err = cmd.RenderHelp("Blocked transactions of {{.Tenant}} in {{.Schema}}", cmd.HelpData{Tenant: "d01", Schema: "sys"})
+	assert.NoError(err)
+	assert.Equal("Blocked transactions of d01 in sys", help)
+
+	// invalid templates are detected at the start
+	config := getTestConfig(2, 1)
+	config.Metrics[0].Help = "Blocked transactions of {{.Tenant}"
+	assert.NotNil(config.ValidateMetrics())
+	config.Metrics[0].Help = "Blocked transactions of {{.Host}}"
+	assert.NotNil(config.ValidateMetrics())
+
+	// the collector interpolates the tenants and schemas of every metric family
+	config = getTestConfig(1, 2)
+	config.Tenants[1].MetricPrefix = "p02"
+	config.Tenants[1].Schemas = []string{"sys"}
+	config.Metrics[0].Help = "Blocked transactions of {{.Tenant}} in {{.Schema}}"
+	config.DataFunc = func(ctx context.Context, mPos, tPos int) []cmd.MetricRecord {
+		return config.AddOrigin(mPos, tPos, config.AddPrefix(tPos, config.GetTestData1(ctx, mPos, tPos)))
+	}
+
+	var buf strings.Builder
+	err = config.WriteMetrics(&buf)
+	assert.NoError(err)
+	assert.Contains(buf.String(), "# HELP m1 Blocked transactions of d01 in sys\n")
+	assert.Contains(buf.String(), "# HELP p02_m1 Blocked transactions of d02 in sys\n")
+}
+
+func Test_ConfigHash(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 2)
+
+	hash1, err := config.ConfigHash()
+	assert.Nil(err)
+	assert.Len(hash1, 64)
+
+	// same config, same hash
+	hash2, err := getTestConfig(2, 2).ConfigHash()
+	assert.Nil(err)
+	assert.Equal(hash1, hash2)
+
+	// secrets are not part of the hash
+	config.Secret = []byte("secret")
+	hash2, err = config.ConfigHash()
+	assert.Nil(err)
+	assert.Equal(hash1, hash2)
+
+	// changed metric definition
+	config.Metrics[1].SQL = "select 1 from dummy"
+	hash2, err = config.ConfigHash()
+	assert.Nil(err)
+	assert.NotEqual(hash1, hash2)
+
+	// exporter metric with hash label
+	md := config.ExporterMetrics()
+	assert.Equal("hana_sql_exporter_config_hash", md[1].Name)
+	assert.Equal([]string{"hash"}, md[1].Stats[0].Labels)
+}
+
+func Test_TenantInfoMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(0, 3)
+	config.Tenants[0].ConnStr = "Host1.example.com:30041"
+	config.Tenants[0].Usage = "PRODUCTION"
+	config.Tenants[1].ConnStr = "host2"
+	config.Tenants[2].Tags = []string{"bw", "abap"}
+	config.Tenants[2].User = "dbuser"
+
+	md := config.TenantInfoMetrics()
+	assert.Equal("hana_sql_exporter_tenant_info", md.Name)
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 1, Labels: []string{"tenant", "usage", "host", "tags"}, LabelValues: []string{"d01", "production", "host1.example.com", ""}},
+		{Value: 1, Labels: []string{"tenant", "usage", "host", "tags"}, LabelValues: []string{"d02", "", "host2", ""}},
+		{Value: 1, Labels: []string{"tenant", "usage", "host", "tags"}, LabelValues: []string{"d03", "", "", "bw,abap"}},
+	}, md.Stats)
+}
+
+func Test_ReviveTenants(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DataFunc = config.GetTestData1
+
+	// tenant is down during the first scrape and up during the second
+	var attempts int
+	release := make(chan struct{})
+	config.ConnectFunc = func(ctx context.Context, tPos int) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("connection refused")
+		}
+		<-release
+		config.SetConnections(tPos, openNamedMockDB(t, "revive"), nil)
+		return nil
+	}
+
+	res := config.CollectMetrics()
+	assert.Nil(res)
+	config.WaitReconnects()
+	up := config.ExporterMetrics()[0]
+	assert.Equal("hana_sql_exporter_tenant_up", up.Name)
+	assert.Equal(0.0, up.Stats[0].Value)
+
+	// the tenant is skipped, while it is reconnected in the background
+	assert.Nil(config.CollectMetrics())
+	close(release)
+	config.WaitReconnects()
+	res = config.CollectMetrics()
+	assert.Equal([]cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}}, res)
+	up = config.ExporterMetrics()[0]
+	assert.Equal(1.0, up.Stats[0].Value)
+	assert.Equal(2, attempts)
+}
+
+func Test_GetMetricDataConnection(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+
+	sel := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockResult("tenantdb", sel, []string{"count"}, []driver.Value{int64(1)})
+	setNamedMockResult("systemdb", sel, []string{"count"}, []driver.Value{int64(5)})
+
+	// without system db connection the system metric is skipped
+	config.SetConnections(0, openNamedMockDB(t, "tenantdb"), nil)
+	config.Metrics[0].Connection = "system"
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// the metric is routed to the system db
+	config.SetConnections(0, openNamedMockDB(t, "tenantdb"), openNamedMockDB(t, "systemdb"))
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(5.0, md[0].Value)
+
+	// by default the tenant db is used
+	config.Metrics[0].Connection = ""
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(1.0, md[0].Value)
+}
+
+func Test_CommentQuery(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "comment"), nil)
+
+	sel := "select count(*) from sys.m_blocked_transactions"
+	assert.Equal(sel, config.CommentQuery(0, 0, sel))
+
+	// the comment is prepended and the query still runs
+	config.QueryComment = true
+	commented := "/* hana_sql_exporter metric=m1 tenant=d01 */ " + sel
+	assert.Equal(commented, config.CommentQuery(0, 0, sel))
+	setNamedMockResult("comment", commented, []string{"count"}, []driver.Value{int64(3)})
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(3.0, md[0].Value)
+
+	// names can't end the comment
+	config.Tenants[0].Name = "d01*/ drop"
+	assert.Equal("/* hana_sql_exporter metric=m1 tenant=d01 drop */ "+sel, config.CommentQuery(0, 0, sel))
+}
+
+func Test_GetMetricDataPool(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Pools = []cmd.PoolInfo{{Name: "Heavy", MaxOpenConns: 2}}
+	config.Metrics[0].Pool = "heavy"
+	assert.Nil(config.ValidateMetrics())
+
+	sel := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockResult("light", sel, []string{"count"}, []driver.Value{int64(1)})
+	setNamedMockResult("heavy", sel, []string{"count"}, []driver.Value{int64(9)})
+	config.SetConnections(0, openNamedMockDB(t, "light"), nil)
+
+	// without pool connection the metric is skipped
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// the metric uses its designated pool
+	config.Tenants[0].SetPool("Heavy", openNamedMockDB(t, "heavy"))
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(9.0, md[0].Value)
+
+	// unknown pool
+	config.Metrics[0].Pool = "reporting"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_CounterFraction(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].MetricType = "counter"
+	config.SetConnections(0, openNamedMockDB(t, "fraction"), nil)
+	setNamedMockResult("fraction", "select count(*) from sys.m_blocked_transactions", []string{"count"}, []driver.Value{12.6})
+
+	// warning by default, the value is kept
+	assert.Nil(config.ValidateMetrics())
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	md := config.GetMetricData(context.Background(), 0, 0)
+	log.SetOutput(os.Stderr)
+	assert.Equal(12.6, md[0].Value)
+	assert.Contains(buf.String(), "fractional value")
+
+	config.Metrics[0].CounterFraction = "round"
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(13.0, md[0].Value)
+
+	// accepted without warning
+	config.Metrics[0].CounterFraction = "Accept"
+	buf.Reset()
+	log.SetOutput(&buf)
+	md = config.GetMetricData(context.Background(), 0, 0)
+	log.SetOutput(os.Stderr)
+	assert.Equal(12.6, md[0].Value)
+	assert.NotContains(buf.String(), "fractional value")
+
+	// gauges are not checked
+	config.Metrics[0].MetricType = "gauge"
+	config.Metrics[0].CounterFraction = "round"
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(12.6, md[0].Value)
+
+	config.Metrics[0].CounterFraction = "truncate"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_NullAsZero(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].MetricType = "counter"
+	config.SetConnections(0, openNamedMockDB(t, "nulls"), nil)
+	setNamedMockResult("nulls", "select count(*) from sys.m_blocked_transactions", []string{"count", "host"},
+		[]driver.Value{nil, "h1"},
+		[]driver.Value{math.NaN(), "h2"},
+		[]driver.Value{int64(4), "h3"},
+	)
+
+	// NULL fails the metric by default
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// coerced to zero, the series stay continuous
+	config.Metrics[0].NullAsZero = true
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(3, len(md))
+	assert.Equal([]float64{0, 0, 4}, []float64{md[0].Value, md[1].Value, md[2].Value})
+
+	// NULL labels still fail
+	setNamedMockResult("nulls", "select count(*) from sys.m_blocked_transactions", []string{"count", "host"},
+		[]driver.Value{int64(1), nil},
+	)
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+}
+
+func Test_MemoryLimit(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "memlimit"), nil)
+	setNamedMockResult("memlimit", "select count(*) from sys.m_blocked_transactions", []string{"count"}, []driver.Value{int64(3)})
+
+	// no session variable by default
+	assert.Equal(1, len(config.GetMetricData(context.Background(), 0, 0)))
+	assert.Nil(mockExecuted("memlimit"))
+
+	// set before and reset after the query
+	config.Metrics[0].MemoryLimit = "2"
+	assert.Nil(config.ValidateMetrics())
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(3.0, md[0].Value)
+	assert.Equal([]string{"set 'STATEMENT_MEMORY_LIMIT' = '2'", "unset 'STATEMENT_MEMORY_LIMIT'"}, mockExecuted("memlimit"))
+
+	// the metric fails, if the limit can't be set
+	setNamedMockError("memlimit", "set 'STATEMENT_MEMORY_LIMIT' = '2'", errors.New("invalid session variable"))
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	for _, limit := range []string{"0", "2GB", "-1", "1.5"} {
+		config.Metrics[0].MemoryLimit = limit
+		assert.NotNil(config.ValidateMetrics())
+	}
+}
+
+func Test_NullMode(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "nullmode"), nil)
+	setNamedMockResult("nullmode", "select count(*) from sys.m_blocked_transactions", []string{"count", "host"},
+		[]driver.Value{nil, "h1"},
+		[]driver.Value{int64(2), nil},
+		[]driver.Value{int64(3), "h3"},
+	)
+	values := func(md []cmd.MetricRecord) ([]float64, []string) {
+		var v []float64
+		var hosts []string
+		for _, record := range md {
+			v = append(v, record.Value)
+			hosts = append(hosts, record.LabelValues[2])
+		}
+		return v, hosts
+	}
+
+	// NULL fails the metric by default
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	config.Metrics[0].NullMode = "error"
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// rows with NULL are skipped
+	config.Metrics[0].NullMode = "skip"
+	v, hosts := values(config.GetMetricData(context.Background(), 0, 0))
+	assert.Equal([]float64{3}, v)
+	assert.Equal([]string{"h3"}, hosts)
+
+	// NULL values become zero and NULL labels empty
+	config.Metrics[0].NullMode = "Zero"
+	v, hosts = values(config.GetMetricData(context.Background(), 0, 0))
+	assert.Equal([]float64{0, 2, 3}, v)
+	assert.Equal([]string{"h1", "", "h3"}, hosts)
+
+	// NULL labels become empty, rows with NULL value are skipped
+	config.Metrics[0].NullMode = "empty"
+	v, hosts = values(config.GetMetricData(context.Background(), 0, 0))
+	assert.Equal([]float64{2, 3}, v)
+	assert.Equal([]string{"", "h3"}, hosts)
+
+	// NullAsZero still coerces the value column
+	config.Metrics[0].NullAsZero = true
+	v, hosts = values(config.GetMetricData(context.Background(), 0, 0))
+	assert.Equal([]float64{0, 2, 3}, v)
+	assert.Equal([]string{"h1", "", "h3"}, hosts)
+
+	// NULL in a dropped column neither fails nor skips the row
+	config.Metrics[0].NullAsZero = false
+	setNamedMockResult("nullmode", "select count(*) from sys.m_blocked_transactions", []string{"count", "host", "port"},
+		[]driver.Value{int64(1), "h1", nil},
+		[]driver.Value{int64(2), "h2", "30003"},
+	)
+	config.Metrics[0].DropColumns = []string{"port"}
+	for _, mode := range []string{"", "skip", "empty"} {
+		config.Metrics[0].NullMode = mode
+		v, hosts = values(config.GetMetricData(context.Background(), 0, 0))
+		assert.Equal([]float64{1, 2}, v)
+		assert.Equal([]string{"h1", "h2"}, hosts)
+	}
+	config.Metrics[0].DropColumns = nil
+
+	assert.Nil(config.ValidateMetrics())
+	config.Metrics[0].NullMode = "nan"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_MaskTenant(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 2)
+	config.Tenants[1].Schemas = []string{"sys"}
+	config.SetConnections(0, openNamedMockDB(t, "mask0"), nil)
+	config.SetConnections(1, openNamedMockDB(t, "mask1"), nil)
+	for _, name := range []string{"mask0", "mask1"} {
+		setNamedMockResult(name, "select count(*) from sys.m_blocked_transactions", []string{"count"}, []driver.Value{int64(1)})
+	}
+
+	// not masked by default
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal("d01", md[0].LabelValues[0])
+
+	// alias or keyed hash of the name
+	config.Metrics[0].MaskTenant = true
+	config.Tenants[0].Alias = "Customer_A"
+	config.MaskKey = "k1"
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]string{"tenant", "usage"}, md[0].Labels)
+	assert.Equal("customer_a", md[0].LabelValues[0])
+	assert.Equal("customer_a", md[0].Tenant)
+
+	md = config.GetMetricData(context.Background(), 0, 1)
+	assert.Equal(12, len(md[0].LabelValues[0]))
+	assert.NotContains(md[0].LabelValues[0], "d02")
+	assert.Equal(config.TenantMask("D02"), md[0].LabelValues[0])
+	assert.NotEqual(config.TenantMask("d01"), config.TenantMask("d03"))
+
+	// the hash depends on the key, so that short names can't be guessed
+	unkeyed := sha256.Sum256([]byte("d02"))
+	assert.NotEqual(hex.EncodeToString(unkeyed[:])[:12], md[0].LabelValues[0])
+	config.MaskKey = "k2"
+	assert.NotEqual(config.TenantMask("d02"), md[0].LabelValues[0])
+
+	// without key every tenant needs an alias
+	config.MaskKey = ""
+	assert.NotNil(config.ValidateMetrics())
+	config.Tenants[1].Alias = "customer_b"
+	assert.Nil(config.ValidateMetrics())
+	config.MaskKey = "k1"
+
+	// tenant names as metric prefix would reveal the tenant
+	assert.Nil(config.ValidateMetrics())
+	config.TenantPrefix = true
+	assert.NotNil(config.ValidateMetrics())
+	config.Tenants[0].MetricPrefix = "c1"
+	config.Tenants[1].MetricPrefix = "c2"
+	assert.Nil(config.ValidateMetrics())
+}
+
+func Test_InvalidValues(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "invalid"), nil)
+	setNamedMockResult("invalid", "select count(*) from sys.m_blocked_transactions", []string{"ratio", "host"},
+		[]driver.Value{math.Inf(1), "h1"},
+		[]driver.Value{-5e12, "h2"},
+		[]driver.Value{0.5, "h3"},
+	)
+
+	// kept by default
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(3, len(md))
+	assert.True(math.IsInf(md[0].Value, 1))
+
+	// dropped
+	config.Metrics[0].InvalidValues = "drop"
+	config.Metrics[0].ValueLimit = 1e9
+	assert.Nil(config.ValidateMetrics())
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(0.5, md[0].Value)
+	assert.Equal(1, len(config.LastErrorMetrics().Stats))
+
+	// capped to the limit
+	config.Metrics[0].InvalidValues = "cap"
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]float64{1e9, -1e9, 0.5}, []float64{md[0].Value, md[1].Value, md[2].Value})
+
+	config.Metrics[0].InvalidValues = "clamp"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_WordSeparator(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "words"), nil)
+	setNamedMockResult("words", "select count(*) from sys.m_blocked_transactions", []string{"count", "service"},
+		[]driver.Value{int64(1), "Index Server"},
+	)
+	service := func() string {
+		md := config.GetMetricData(context.Background(), 0, 0)
+		return md[0].LabelValues[2]
+	}
+
+	// underscore by default
+	assert.Equal("index_server", service())
+
+	// global separator, the spaces are kept
+	space, dash := " ", "-"
+	config.WordSeparator = &space
+	config.InheritWordSeparator()
+	assert.Equal("index server", service())
+
+	// own separator of the metric
+	config.Metrics[0].WordSeparator = &dash
+	config.InheritWordSeparator()
+	assert.Equal("index-server", service())
+}
+
+func Test_PreserveCase(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "case"), nil)
+	setNamedMockResult("case", "select count(*) from sys.m_blocked_transactions", []string{"count", "Service_Name"},
+		[]driver.Value{int64(1), "IndexServer"},
+	)
+
+	// lowercased by default
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]string{"tenant", "usage", "service_name"}, md[0].Labels)
+	assert.Equal("indexserver", md[0].LabelValues[2])
+
+	// global option, the tenant labels stay lowercase
+	preserve, lower := true, false
+	config.PreserveCase = &preserve
+	config.InheritPreserveCase()
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]string{"tenant", "usage", "Service_Name"}, md[0].Labels)
+	assert.Equal("IndexServer", md[0].LabelValues[2])
+
+	// own option of the metric
+	config.Metrics[0].PreserveCase = &lower
+	config.InheritPreserveCase()
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal("indexserver", md[0].LabelValues[2])
+
+	// the uppercase columns le and sum of a histogram are found and the
+	// values are still trimmed
+	config.Metrics[0].PreserveCase = &preserve
+	config.Metrics[0].MetricType = "histogram"
+	config.InheritPreserveCase()
+	setNamedMockResult("case", "select count(*) from sys.m_blocked_transactions", []string{"COUNT", "LE", "SUM", "Service_Name"},
+		[]driver.Value{int64(2), "1", "3", "IndexServer\t"},
+	)
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal([]string{"tenant", "usage", "Service_Name"}, md[0].Labels)
+	assert.Equal("IndexServer", md[0].LabelValues[2])
+	assert.Equal(&cmd.HistogramData{Buckets: map[float64]uint64{1: 2}, Count: 2, Sum: 3}, md[0].Histogram)
+}
+
+func Test_TimeColumn(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "timecolumn"), nil)
+	recent := time.Now().Add(-time.Minute).Truncate(time.Millisecond).UTC()
+	old := recent.Add(-2 * time.Hour)
+	setNamedMockResult("timecolumn", "select count(*) from sys.m_blocked_transactions", []string{"count", "taken", "volume"},
+		[]driver.Value{int64(5), recent, "v1"},
+		[]driver.Value{int64(7), old, "v2"},
+		[]driver.Value{int64(9), nil, "v3"},
+	)
+	config.DataFunc = config.GetMetricData
+
+	// the time column is no label, NULL means scrape time
+	config.Metrics[0].TimeColumn = "TAKEN"
+	assert.Nil(config.ValidateMetrics())
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Len(md, 3)
+	assert.Equal([]string{"tenant", "usage", "volume"}, md[0].Labels)
+	assert.True(recent.Equal(md[0].Timestamp))
+	assert.True(old.Equal(md[1].Timestamp))
+	assert.True(md[2].Timestamp.IsZero())
+
+	// the samples carry the timestamps
+	var buf strings.Builder
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.Contains(buf.String(), `volume="v1"} 5 `+strconv.FormatInt(recent.UnixNano()/int64(time.Millisecond), 10)+"\n")
+	assert.Contains(buf.String(), `volume="v3"} 9`+"\n")
+
+	// stale samples are skipped
+	config.Metrics[0].MaxAge = 3600
+	assert.Nil(config.ValidateMetrics())
+	md = config.GetMetricData(context.Background(), 0, 0)
+	assert.Len(md, 2)
+	assert.Equal("v1", md[0].LabelValues[2])
+	assert.Equal("v3", md[1].LabelValues[2])
+
+	// HANA timestamp strings
+	ts, err := cmd.ParseTimestamp([]byte("2026-10-15 08:30:00.1234567"))
+	assert.NoError(err)
+	assert.Equal(time.Date(2026, 10, 15, 8, 30, 0, 123456700, time.UTC), ts)
+	_, err = cmd.ParseTimestamp([]byte("yesterday"))
+	assert.Error(err)
+
+	// the maximum age requires a time column
+	config.Metrics[0].TimeColumn = ""
+	assert.NotNil(config.ValidateMetrics())
+	config.Metrics[0].MaxAge = 0
+	config.Metrics[0].TimeColumn = "count"
+	config.Metrics[0].ValueColumn = "count"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_MaxValue(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "maxvalue"), nil)
+	setNamedMockResult("maxvalue", "select count(*) from sys.m_blocked_transactions", []string{"used", "total", "volume"},
+		[]driver.Value{100.3, 100.0, "v1"},
+		[]driver.Value{80.0, 50.0, "v2"},
+		[]driver.Value{20.0, nil, "v3"},
+	)
+	values := func(md []cmd.MetricRecord) []float64 {
+		var v []float64
+		for _, record := range md {
+			v = append(v, record.Value)
+		}
+		return v
+	}
+
+	// capped at a constant
+	max := 100.0
+	config.Metrics[0].MaxValue = &max
+	config.Metrics[0].LabelColumns = []string{"volume"}
+	config.Metrics[0].NullMode = "zero"
+	assert.Nil(config.ValidateMetrics())
+	assert.Equal([]float64{100, 80, 20}, values(config.GetMetricData(context.Background(), 0, 0)))
+
+	// capped at the column of the row, which is no label, NULL doesn't cap
+	config.Metrics[0].MaxValue = nil
+	config.Metrics[0].NullMode = ""
+	config.Metrics[0].MaxColumn = "TOTAL"
+	assert.Nil(config.ValidateMetrics())
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]float64{100, 50, 20}, values(md))
+	assert.Equal([]string{"tenant", "usage", "volume"}, md[0].Labels)
+
+	// the smaller maximum wins
+	max = 40
+	config.Metrics[0].MaxValue = &max
+	assert.Equal([]float64{40, 40, 20}, values(config.GetMetricData(context.Background(), 0, 0)))
+
+	// unknown column
+	config.Metrics[0].MaxColumn = "capacity"
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+
+	// invalid cap sources
+	config.Metrics[0].MaxColumn = "used"
+	config.Metrics[0].ValueColumn = "used"
+	assert.NotNil(config.ValidateMetrics())
+	config.Metrics[0].MaxColumn = "total;"
+	assert.NotNil(config.ValidateMetrics())
+	config.Metrics[0].MaxColumn = ""
+	nan := math.NaN()
+	config.Metrics[0].MaxValue = &nan
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_NegativeValues(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.SetConnections(0, openNamedMockDB(t, "negative"), nil)
+	setNamedMockResult("negative", "select count(*) from sys.m_blocked_transactions", []string{"delta", "volume"},
+		[]driver.Value{-2.5, "v1"},
+		[]driver.Value{4.0, "v2"},
+		[]driver.Value{0.0, "v3"},
+	)
+	values := func(md []cmd.MetricRecord) []float64 {
+		var v []float64
+		for _, record := range md {
+			v = append(v, record.Value)
+		}
+		return v
+	}
+
+	// kept by default
+	assert.Equal([]float64{-2.5, 4, 0}, values(config.GetMetricData(context.Background(), 0, 0)))
+	config.Metrics[0].NegativeValues = "keep"
+	assert.Equal([]float64{-2.5, 4, 0}, values(config.GetMetricData(context.Background(), 0, 0)))
+
+	// absolute value
+	config.Metrics[0].NegativeValues = "Abs"
+	assert.Equal([]float64{2.5, 4, 0}, values(config.GetMetricData(context.Background(), 0, 0)))
+
+	// clamped to zero
+	config.Metrics[0].NegativeValues = "zero"
+	assert.Equal([]float64{0, 4, 0}, values(config.GetMetricData(context.Background(), 0, 0)))
+
+	// rejected
+	config.Metrics[0].NegativeValues = "drop"
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal([]float64{4, 0}, values(md))
+	assert.Equal("v2", md[0].LabelValues[2])
+	assert.Equal(0, len(config.LastErrorMetrics().Stats))
+
+	assert.Nil(config.ValidateMetrics())
+	config.Metrics[0].NegativeValues = "clamp"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_Histogram(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].MetricType = "histogram"
+	config.SetConnections(0, openNamedMockDB(t, "histogram"), nil)
+	setNamedMockResult("histogram", "select count(*) from sys.m_blocked_transactions", []string{"count", "le", "sum", "host"},
+		[]driver.Value{3.0, "0.5", "7.5", "h1"},
+		[]driver.Value{5.0, "1", "7.5", "h1"},
+		[]driver.Value{6.0, "+Inf", "7.5", "h1"},
+		[]driver.Value{1.0, "1", "0.25", "h2"},
+	)
+
+	// one histogram per host
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(2, len(md))
+	assert.Equal([]string{"tenant", "usage", "host"}, md[0].Labels)
+	assert.Equal(&cmd.HistogramData{Buckets: map[float64]uint64{0.5: 3, 1: 5}, Count: 6, Sum: 7.5}, md[0].Histogram)
+	assert.Equal(6.0, md[0].Value)
+	assert.Equal(&cmd.HistogramData{Buckets: map[float64]uint64{1: 1}, Count: 1, Sum: 0.25}, md[1].Histogram)
+
+	config.DataFunc = config.GetMetricData
+	var buf strings.Builder
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.Contains(buf.String(), `m1_bucket{host="h1",tenant="d01",usage="",le="0.5"} 3`)
+	assert.Contains(buf.String(), `m1_count{host="h1",tenant="d01",usage=""} 6`)
+
+	// malformed results are rejected
+	setNamedMockResult("histogram", "select count(*) from sys.m_blocked_transactions", []string{"count", "le", "sum"},
+		[]driver.Value{3.0, "0.5", "1"},
+		[]driver.Value{2.0, "1", "1"},
+	)
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+}
+
+func Test_Summary(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].MetricType = "summary"
+	config.SetConnections(0, openNamedMockDB(t, "summary"), nil)
+	query := "select count(*) from sys.m_blocked_transactions"
+	setNamedMockResult("summary", query, []string{"count", "sum", "q1", "v1", "q2", "v2"},
+		[]driver.Value{int64(10), 4.5, 0.5, 0.3, 0.9, 1.2},
+	)
+
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal(&cmd.SummaryData{Quantiles: map[float64]float64{0.5: 0.3, 0.9: 1.2}, Count: 10, Sum: 4.5}, md[0].Summary)
+
+	config.DataFunc = config.GetMetricData
+	var buf strings.Builder
+	assert.NoError(config.WriteMetrics(&buf))
+	assert.Contains(buf.String(), `m1{tenant="d01",usage="",quantile="0.9"} 1.2`)
+	assert.Contains(buf.String(), `m1_sum{tenant="d01",usage=""} 4.5`)
+
+	// results not matching the summary contract are rejected
+	for _, res := range []struct {
+		cols []string
+		row  []driver.Value
+	}{
+		{[]string{"count", "sum", "q1"}, []driver.Value{int64(1), 1.0, 0.5}},
+		{[]string{"count", "sum"}, []driver.Value{int64(1), 1.0}},
+		{[]string{"count", "sum", "q1", "v1"}, []driver.Value{int64(1), 1.0, 1.5, 1.0}},
+		{[]string{"count", "sum", "q1", "v1"}, []driver.Value{"x", 1.0, 0.5, 1.0}},
+	} {
+		setNamedMockResult("summary", query, res.cols, res.row)
+		assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	}
+}
+
+func Test_HistogramRecords(t *testing.T) {
+	assert := assert.New(t)
+	rec := func(value float64, le, sum string) cmd.MetricRecord {
+		return cmd.MetricRecord{Value: value, Labels: []string{"tenant", "le", "sum"}, LabelValues: []string{"d01", le, sum}}
+	}
+
+	// without +Inf bucket the count is the one of the largest bucket
+	md, err := cmd.HistogramRecords([]cmd.MetricRecord{rec(4, "2,5", "3,5"), rec(1, "1", "3,5")}, ",")
+	assert.NoError(err)
+	assert.Equal([]string{"tenant"}, md[0].Labels)
+	assert.Equal(&cmd.HistogramData{Buckets: map[float64]uint64{1: 1, 2.5: 4}, Count: 4, Sum: 3.5}, md[0].Histogram)
+
+	for _, md := range [][]cmd.MetricRecord{
+		{{Value: 1, Labels: []string{"le"}, LabelValues: []string{"1"}}},
+		{rec(1, "x", "1")},
+		{rec(1.5, "1", "1")},
+		{rec(1, "1", "1"), rec(2, "1", "1")},
+		{rec(1, "1", "1"), rec(2, "2", "3")},
+		{rec(3, "1", "1"), rec(2, "+Inf", "1")},
+	} {
+		_, err := cmd.HistogramRecords(md, ".")
+		assert.Error(err)
+	}
+}
+
+func Test_TableSizeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(0, 1)
+	config.Metrics = cmd.TableSizeMetrics(3)
+	config.SetConnections(0, openMockDB(t), nil)
+
+	// the mock ignores the top clause and returns all tables
+	var rows [][]driver.Value
+	for i := 0; i < 10; i++ {
+		rows = append(rows, []driver.Value{int64(1000 - i), "sapabap1", fmt.Sprintf("table%d", i)})
+	}
+	setMockResult(config.GetSelection(0, 0), []string{"memory_size", "schema_name", "table_name"}, rows...)
+
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(3, len(md))
+	assert.Equal(1000.0, md[0].Value)
+	assert.Equal([]string{"d01", "", "sapabap1", "table0"}, md[0].LabelValues)
+}
+
+func Test_CollectRemainingTenantInfos(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(0, 1)
+	config.SetConnections(0, openNamedMockDB(t, "discovery"), nil)
+
+	sel := "select usage from sys.m_database"
+	setNamedMockResult("discovery", sel, []string{"usage"}, []driver.Value{"production"})
+	setNamedMockResult("discovery", "select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", []string{"schema_name"}, []driver.Value{"sapabap1"})
+	assert.NoError(config.CollectRemainingTenantInfos(context.Background(), 0))
+	assert.Equal("production", config.Tenants[0].Usage)
+	assert.Equal([]string{"sys", "sapabap1"}, config.Tenants[0].Schemas)
+
+	// a hanging discovery query fails after the init timeout
+	config.InitTimeout = 0.05
+	setMockDelay("discovery:"+sel, time.Minute)
+	setMockDelay("discovery:select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", time.Minute)
+	start := time.Now()
+	assert.Error(config.CollectRemainingTenantInfos(context.Background(), 0))
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func Test_CollectRemainingTenantInfosUsage(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.DefaultUsage = "unknown"
+	config.SetConnections(0, openNamedMockDB(t, "nousage"), nil)
+
+	// the tenant is kept with the default usage, if the usage query fails
+	setNamedMockError("nousage", "select usage from sys.m_database", errors.New("insufficient privilege"))
+	setNamedMockResult("nousage", "select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", []string{"schema_name"})
+	assert.NoError(config.CollectRemainingTenantInfos(context.Background(), 0))
+	assert.Equal("unknown", config.Tenants[0].Usage)
+
+	// and the metrics still work
+	setNamedMockResult("nousage", "select count(*) from sys.m_blocked_transactions", []string{"count"}, []driver.Value{int64(2)})
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(1, len(md))
+	assert.Equal([]string{"d01", "unknown"}, md[0].LabelValues)
+}
+
+func Test_CollectMetricsMockDriver(t *testing.T) {
+	assert := assert.New(t)
+	config := getMockConfig(t, 0, 2)
+	config.Metrics = []cmd.MetricInfo{
+		{
+			Name:       "hdb_ports",
+			Help:       "h1",
+			MetricType: "gauge",
+			SQL:        "select value, host_name, port from <SCHEMA>.m_ports",
+		},
+		{
+			Name:       "hdb_nulls",
+			Help:       "h2",
+			MetricType: "gauge",
+			SQL:        "select value, host_name from <SCHEMA>.m_nulls",
+		},
+	}
+
+	tenants, err := config.Prepare()
+	assert.NoError(err)
+	assert.Equal(2, len(tenants))
+
+	// labels and numeric values of the first tenant
+	setNamedMockResult(mockDSN(config, 0), "select value, host_name, port from sys.m_ports", []string{"VALUE", "HOST_NAME", "PORT"},
+		[]driver.Value{12.5, "Host A", "30003"},
+		[]driver.Value{int64(7), "hostB", "30015"},
+	)
+
+	// NULL values of the second tenant skip the tenant
+	setNamedMockResult(mockDSN(config, 1), "select value, host_name, port from sys.m_ports", []string{"VALUE", "HOST_NAME", "PORT"},
+		[]driver.Value{1.0, nil, "30003"},
+	)
+	setMockResult("select value, host_name from sys.m_nulls", []string{"VALUE", "HOST_NAME"}, []driver.Value{nil, "host"})
+
+	md := config.CollectMetrics()
+	assert.Equal([]cmd.MetricData{
+		{
+			Name:       "hdb_ports",
+			Help:       "h1",
+			MetricType: "gauge",
+			Stats: []cmd.MetricRecord{
+				{Value: 12.5, Labels: []string{"tenant", "usage", "host_name", "port"}, LabelValues: []string{"d01", "production", "host_a", "30003"}, Tenant: "d01", Schema: "sys"},
+				{Value: 7, Labels: []string{"tenant", "usage", "host_name", "port"}, LabelValues: []string{"d01", "production", "hostb", "30015"}, Tenant: "d01", Schema: "sys"},
+			},
+		},
+	}, md)
+}
+
+func Test_CollectMetricsMockDriverTimeout(t *testing.T) {
+	assert := assert.New(t)
+	config := getMockConfig(t, 0, 1)
+	config.Timeout = 1
+	config.TimeoutBuffer = 0.9
+	config.Metrics = []cmd.MetricInfo{
+		{
+			Name:       "hdb_slow",
+			Help:       "h1",
+			MetricType: "gauge",
+			SQL:        "select value from <SCHEMA>.m_slow",
+		},
+	}
+
+	_, err := config.Prepare()
+	assert.NoError(err)
+
+	// the hanging select is abandoned after the scrape timeout
+	sel := mockDSN(config, 0) + ":select value from sys.m_slow"
+	setMockResult(sel, []string{"VALUE"}, []driver.Value{1.0})
+	setMockDelay(sel, 5*time.Second)
+
+	start := time.Now()
+	assert.Nil(config.CollectMetrics())
+	assert.True(time.Since(start) < time.Second)
+}
+
+func Test_CollectMetricsGoroutines(t *testing.T) {
+	assert := assert.New(t)
+	config := getMockConfig(t, 0, 2)
+	config.Timeout = 1
+	config.TimeoutBuffer = 0.95
+	config.Metrics = []cmd.MetricInfo{
+		{
+			Name:       "hdb_hanging",
+			Help:       "h1",
+			MetricType: "gauge",
+			SQL:        "select value from <SCHEMA>.m_hanging",
+		},
+	}
+
+	_, err := config.Prepare()
+	assert.NoError(err)
+
+	setMockResult("select value from sys.m_hanging", []string{"VALUE"}, []driver.Value{1.0})
+	setMockDelay("select value from sys.m_hanging", time.Hour)
+
+	// the hanging queries are cancelled with the timed out scrapes
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		assert.Nil(config.CollectMetrics())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(runtime.NumGoroutine() <= before+2)
+}
+
+func Test_ScrapeParams(t *testing.T) {
+	assert := assert.New(t)
+	config := getMockConfig(t, 0, 1)
+	config.Metrics = []cmd.MetricInfo{
+		{
+			Name:       "hdb_info",
+			Help:       "h1",
+			MetricType: "gauge",
+			SQL:        "select value from <SCHEMA>.m_info",
+		},
+		{
+			Name:       "hdb_connection",
+			Help:       "h2",
+			MetricType: "gauge",
+			SQL:        "select used_memory_size from <SCHEMA>.m_connections where connection_id = ?",
+			Params:     []string{"conn_id"},
+		},
+	}
+	assert.NoError(config.ValidateMetrics())
+
+	_, err := config.Prepare()
+	assert.NoError(err)
+
+	sel := "select used_memory_size from sys.m_connections where connection_id = ?"
+	setNamedMockResult(mockDSN(config, 0), sel, []string{"USED_MEMORY_SIZE"}, []driver.Value{int64(42)})
+	setNamedMockResult(mockDSN(config, 0), "select value from sys.m_info", []string{"VALUE"}, []driver.Value{int64(1)})
+
+	handler := config.FilterHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "unfiltered")
+	}))
+	scrape := func(url string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	// the parameter is bound to the select of the declaring metric
+	code, out := scrape("/metrics?metric=hdb_connection&param_conn_id=123")
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(out, `hdb_connection{tenant="d01",usage="production"} 42`)
+	assert.Equal([]driver.Value{"123"}, lastMockArgs(mockDSN(config, 0), sel))
+
+	// parameters not declared by the requested metrics are rejected
+	code, _ = scrape("/metrics?metric=hdb_info&param_conn_id=123")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = scrape("/metrics?param_unknown=1")
+	assert.Equal(http.StatusBadRequest, code)
+
+	// metrics with parameters are skipped by scrapes without them
+	md := config.CollectMetrics()
+	assert.Equal(1, len(md))
+	assert.Equal("hdb_info", md[0].Name)
+
+	// invalid parameter names
+	config.Metrics[1].Params = []string{"conn-id"}
+	assert.Error(config.ValidateMetrics())
+}
+
 func Test_GetMetricRows(t *testing.T) {
 
 	assert := assert.New(t)
@@ -105,8 +2388,481 @@ func Test_GetMetricRows(t *testing.T) {
 
 	// rows.Columns
 	rows := &sql.Rows{}
-	_, err := ti.GetMetricRows(rows)
+	_, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+}
+
+func Test_GetMetricRowsValueColumn(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	query := "select host, used_memory, port from sys.m_service_memory"
+	setMockResult(query, []string{"HOST", "USED_MEMORY", "PORT"},
+		[]driver.Value{"hana1", int64(100), "30003"},
+		[]driver.Value{"hana2", int64(200), "30040"},
+	)
+
+	// first column is not numeric
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+
+	// named value column, all other columns are labels
+	config.Metrics[0].ValueColumn = "used_memory"
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.Nil(err)
+	rows.Close()
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 100, Labels: []string{"tenant", "usage", "host", "port"}, LabelValues: []string{"d01", "", "hana1", "30003"}},
+		{Value: 200, Labels: []string{"tenant", "usage", "host", "port"}, LabelValues: []string{"d01", "", "hana2", "30040"}},
+	}, md)
+
+	// unknown value column
+	config.Metrics[0].ValueColumn = "free_memory"
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+}
+
+func Test_ValueModeInfo(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	query := "select host, version, port from sys.m_host_information"
+	setMockResult(query, []string{"HOST", "VERSION", "PORT"},
+		[]driver.Value{"hana1", "2.00.059", int64(30003)},
+	)
+
+	// default stays unchanged
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+
+	// all columns are labels with constant value
+	config.Metrics[0].ValueMode = "Info"
+	assert.Nil(config.ValidateMetrics())
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.Nil(err)
+	rows.Close()
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 1, Labels: []string{"tenant", "usage", "host", "version", "port"}, LabelValues: []string{"d01", "", "hana1", "2.00.059", "30003"}},
+	}, md)
+
+	config.Metrics[0].ValueMode = "count"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_DescColumn(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	query := "select version, comment from sys.m_database"
+	setMockResult(query, []string{"VERSION", "COMMENT"},
+		[]driver.Value{"2.00.059", "  SPS05 Revision 59\n(Maintenance)  "},
+	)
+
+	// the description keeps its case and spaces
+	config.Metrics[0].ValueMode = "info"
+	config.Metrics[0].DescColumn = "comment"
+	assert.Nil(config.ValidateMetrics())
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.Nil(err)
+	rows.Close()
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 1, Labels: []string{"tenant", "usage", "version", "description"}, LabelValues: []string{"d01", "", "2.00.059", "SPS05 Revision 59 (Maintenance)"}},
+	}, md)
+
+	// long descriptions are truncated
+	assert.Equal(128, len(cmd.Description(strings.Repeat("x", 300))))
+
+	// unknown column
+	config.Metrics[0].DescColumn = "text"
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+
+	// only for info metrics
+	config.Metrics[0].ValueMode = ""
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_AutoValueColumn(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].AutoValueColumn = true
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	query := "select host, used_memory, free_memory from sys.m_host_memory"
+	setMockResult(query, []string{"HOST", "USED_MEMORY", "FREE_MEMORY"},
+		[]driver.Value{"hana1", int64(100), int64(5)},
+	)
+
+	// the first numeric column is the value, the log is written once
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	for i := 0; i < 2; i++ {
+		rows, err := db.Query(query)
+		assert.Nil(err)
+		md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+		assert.Nil(err)
+		rows.Close()
+		assert.Equal([]cmd.MetricRecord{
+			{Value: 100, Labels: []string{"tenant", "usage", "host", "free_memory"}, LabelValues: []string{"d01", "", "hana1", "5"}},
+		}, md)
+	}
+	log.SetOutput(os.Stderr)
+	assert.Equal(1, strings.Count(buf.String(), "USED_MEMORY"))
+
+	// no numeric column at all
+	setMockResult(query, []string{"HOST"}, []driver.Value{"hana1"})
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+}
+
+func Test_StripPrefixes(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 1)
+	config.StripPrefixes = []string{"host_", "M_"}
+	config.Metrics[1].StripPrefixes = []string{}
+	config.InheritStripPrefixes()
+	assert.Equal([]string{"host_", "M_"}, config.Metrics[0].StripPrefixes)
+	assert.Equal([]string{}, config.Metrics[1].StripPrefixes)
+
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	// prefixes are stripped after lower casing, the value column keeps its name
+	query := "select m_used, host_name, m_service_port, volume from sys.m_volumes"
+	setMockResult(query, []string{"M_USED", "HOST_NAME", "M_SERVICE_PORT", "VOLUME"},
+		[]driver.Value{int64(100), "hana1", "30003", "1"},
+	)
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.Nil(err)
+	rows.Close()
+	assert.Equal([]string{"tenant", "usage", "name", "service_port", "volume"}, md[0].Labels)
+
+	// the stripped name must be a valid label name
+	config.Metrics[0].StripPrefixes = []string{"volume"}
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+}
+
+func Test_LabelBuckets(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].LabelBuckets = map[string]float64{"build": 10}
+	db := openMockDB(t)
+
+	setMockResult("select cnt, build from buckets", []string{"CNT", "BUILD"},
+		[]driver.Value{int64(1), "1234"},
+		[]driver.Value{int64(2), "1235.5"},
+		[]driver.Value{int64(3), "7"},
+	)
+	rows, err := db.Query("select cnt, build from buckets")
+	assert.NoError(err)
+	md, err := config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.NoError(err)
+	assert.Equal([]string{"1230", "1240", "10"}, []string{md[0].LabelValues[2], md[1].LabelValues[2], md[2].LabelValues[2]})
+
+	// bucketed label column must be numeric
+	setMockResult("select cnt, build from buckets_str", []string{"CNT", "BUILD"}, []driver.Value{int64(1), "sp05"})
+	rows, err = db.Query("select cnt, build from buckets_str")
+	assert.NoError(err)
+	_, err = config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.Error(err)
+
+	// bucket size must be positive
+	assert.NoError(config.ValidateMetrics())
+	config.Metrics[0].LabelBuckets["build"] = 0
+	assert.Error(config.ValidateMetrics())
+}
+
+func Test_LabelNames(t *testing.T) {
+	assert := assert.New(t)
+
+	labels, err := cmd.LabelNames([]string{"VALUE", "HOST", "PORT"}, 0, "", false)
+	assert.NoError(err)
+	assert.Equal([]string{"", "host", "port"}, labels)
+
+	// colliding column names fail by default
+	_, err = cmd.LabelNames([]string{"VALUE", "Host", "HOST"}, 0, "", false)
+	assert.Error(err)
+	_, err = cmd.LabelNames([]string{"VALUE", "TENANT"}, 0, "fail", false)
+	assert.Error(err)
+
+	// or get a suffix
+	labels, err = cmd.LabelNames([]string{"Host", "VALUE", "HOST", "host_2", "tenant"}, 1, "suffix", false)
+	assert.NoError(err)
+	assert.Equal([]string{"host", "", "host_2", "host_2_2", "tenant_2"}, labels)
+
+	// labels added by the exporter are reserved
+	_, err = cmd.LabelNames([]string{"VALUE", "TAGS"}, 0, "", false, "tags")
+	assert.Error(err)
+	labels, err = cmd.LabelNames([]string{"VALUE", "TAGS"}, 0, "suffix", false, "tags")
+	assert.NoError(err)
+	assert.Equal([]string{"", "tags_2"}, labels)
+
+	// metric with colliding columns
+	config := getTestConfig(1, 1)
+	db := openMockDB(t)
+	setMockResult("select cnt, host, HOST from duplicates", []string{"CNT", "host", "HOST"}, []driver.Value{int64(1), "a", "b"})
+	rows, err := db.Query("select cnt, host, HOST from duplicates")
+	assert.NoError(err)
+	_, err = config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.Error(err)
+
+	config.Metrics[0].DuplicateLabels = "suffix"
+	rows, err = db.Query("select cnt, host, HOST from duplicates")
+	assert.NoError(err)
+	md, err := config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.NoError(err)
+	assert.Equal([]string{"tenant", "usage", "host", "host_2"}, md[0].Labels)
+}
+
+func Test_LabelColumns(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	db := openMockDB(t)
+
+	setMockResult("select cnt, host, port, statement_hash from shared", []string{"CNT", "HOST", "PORT", "STATEMENT_HASH"},
+		[]driver.Value{int64(1), "h1", "30003", "abc"},
+	)
+	labels := func() ([]string, []string) {
+		rows, err := db.Query("select cnt, host, port, statement_hash from shared")
+		assert.NoError(err)
+		defer rows.Close()
+		md, err := config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+		assert.NoError(err)
+		return md[0].Labels, md[0].LabelValues
+	}
+
+	// deny-list
+	config.Metrics[0].DropColumns = []string{"statement_hash"}
+	names, values := labels()
+	assert.Equal([]string{"tenant", "usage", "host", "port"}, names)
+	assert.Equal([]string{"d01", "", "h1", "30003"}, values)
+
+	// allow-list
+	config.Metrics[0].DropColumns = nil
+	config.Metrics[0].LabelColumns = []string{"Host"}
+	names, values = labels()
+	assert.Equal([]string{"tenant", "usage", "host"}, names)
+	assert.Equal([]string{"d01", "", "h1"}, values)
+
+	// dropped columns don't collide with other labels
+	config.Metrics[0].LabelColumns = nil
+	config.Metrics[0].DropColumns = []string{"host"}
+	setMockResult("select cnt, host, HOST from dropped", []string{"CNT", "host", "HOST"}, []driver.Value{int64(1), "a", "b"})
+	rows, err := db.Query("select cnt, host, HOST from dropped")
+	assert.NoError(err)
+	md, err := config.Tenants[0].GetMetricRows(rows, &config.Metrics[0])
+	rows.Close()
+	assert.NoError(err)
+	assert.Equal([]string{"tenant", "usage"}, md[0].Labels)
+}
+
+func Test_GateOpen(t *testing.T) {
+	assert := assert.New(t)
+	db := openMockDB(t)
+	defer db.Close()
+
+	// gate skips the metric
+	setMockResult("select count(*) from sys.m_table_locks", []string{"COUNT"}, []driver.Value{int64(0)})
+	open, err := cmd.GateOpen(context.Background(), db, "select count(*) from sys.m_table_locks")
+	assert.Nil(err)
+	assert.False(open)
+
+	// gate allows the metric
+	setMockResult("select count(*) from sys.m_table_locks", []string{"COUNT"}, []driver.Value{int64(3)})
+	open, err = cmd.GateOpen(context.Background(), db, "select count(*) from sys.m_table_locks")
+	assert.Nil(err)
+	assert.True(open)
+
+	// boolean result
+	setMockResult("select true from dummy", []string{"X"}, []driver.Value{true})
+	open, err = cmd.GateOpen(context.Background(), db, "select true from dummy")
+	assert.Nil(err)
+	assert.True(open)
+
+	// only selects are allowed
+	_, err = cmd.GateOpen(context.Background(), db, "delete from sys.m_table_locks")
+	assert.NotNil(err)
+
+	// broken gating query
+	setMockError("select broken from dummy", errors.New("invalid column"))
+	_, err = cmd.GateOpen(context.Background(), db, "select broken from dummy")
+	assert.NotNil(err)
+}
+
+func Test_GetGateSelection(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Metrics[0].GateSQL = " select count(*) from <SCHEMA>.m_table_locks "
+
+	assert.Equal("select count(*) from sys.m_table_locks", config.GetGateSelection(0, 0))
+}
+
+func Test_ParseValue(t *testing.T) {
+	assert := assert.New(t)
+
+	// decimal
+	v, err := cmd.ParseValue([]byte("12.5"), "")
+	assert.Nil(err)
+	assert.Equal(12.5, v)
+
+	// hex encoded
+	v, err = cmd.ParseValue([]byte("0x1F"), "hex")
+	assert.Nil(err)
+	assert.Equal(31.0, v)
+	v, err = cmd.ParseValue([]byte("ff"), "HEX")
+	assert.Nil(err)
+	assert.Equal(255.0, v)
+	_, err = cmd.ParseValue([]byte("0xzz"), "hex")
+	assert.NotNil(err)
+
+	// big-endian binary
+	v, err = cmd.ParseValue([]byte{0x01, 0x00}, "binary")
+	assert.Nil(err)
+	assert.Equal(256.0, v)
+	_, err = cmd.ParseValue([]byte{}, "binary")
 	assert.NotNil(err)
+	_, err = cmd.ParseValue(make([]byte, 9), "binary")
+	assert.NotNil(err)
+
+	// unknown format
+	_, err = cmd.ParseValue([]byte("1"), "octal")
+	assert.NotNil(err)
+}
+
+func Test_DecimalSeparator(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 2)
+	db := openMockDB(t)
+
+	setMockResult("select val, host from comma_decimals", []string{"VAL", "HOST"},
+		[]driver.Value{"12,5", "h1"},
+		[]driver.Value{"7", "h2"},
+	)
+	query := func(tPos int) ([]cmd.MetricRecord, error) {
+		rows, err := db.Query("select val, host from comma_decimals")
+		assert.NoError(err)
+		defer rows.Close()
+		return config.Tenants[tPos].GetMetricRows(rows, &config.Metrics[0])
+	}
+
+	// global separator inherited by tenants without own separator
+	config.DecimalSeparator = ","
+	config.Tenants[1].DecimalSeparator = "."
+	assert.NoError(config.InheritDecimalSeparator())
+	assert.Equal(",", config.Tenants[0].DecimalSeparator)
+
+	md, err := query(0)
+	assert.NoError(err)
+	assert.Equal(12.5, md[0].Value)
+	assert.Equal(7.0, md[1].Value)
+
+	// string values are rejected with the default separator
+	_, err = query(1)
+	assert.Error(err)
+
+	// unsupported separator
+	config.Tenants[1].DecimalSeparator = ";"
+	assert.Error(config.InheritDecimalSeparator())
+}
+
+func Test_ValidateMetrics(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(4, 0)
+
+	assert.Nil(config.ValidateMetrics())
+
+	config.Metrics[1].ValueFormat = "Hex"
+	assert.Nil(config.ValidateMetrics())
+
+	config.Metrics[2].ValueFormat = "octal"
+	assert.NotNil(config.ValidateMetrics())
+
+	config.Metrics[2].ValueFormat = ""
+	config.Metrics[3].Connection = "System"
+	assert.Nil(config.ValidateMetrics())
+
+	config.Metrics[3].Connection = "primary"
+	assert.NotNil(config.ValidateMetrics())
+
+	config.Metrics[3].Connection = ""
+	config.Metrics[0].DuplicateLabels = "Suffix"
+	assert.Nil(config.ValidateMetrics())
+
+	config.Metrics[0].DuplicateLabels = "ignore"
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_FilteredValue(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(3, 3)
+	config.AdaptSchemaFilter()
+
+	// without sentinel the excluded tenant delivers nothing
+	assert.Nil(config.GetMetricData(context.Background(), 2, 0))
+
+	// the sentinel is emitted for the tenant without erp tag
+	sentinel := -1.0
+	config.Metrics[2].FilteredValue = &sentinel
+	assert.False(config.MetricApplies(2, 0))
+	assert.Equal([]cmd.MetricRecord{{Value: -1, Labels: []string{"tenant", "usage"}, LabelValues: []string{"d01", ""}, Tenant: "d01", Schema: "sys"}}, config.GetMetricData(context.Background(), 2, 0))
+
+	// the tags label is added as well
+	config.TagsLabel = true
+	assert.Equal([]cmd.MetricRecord{{Value: -1, Labels: []string{"tenant", "usage", "tags"}, LabelValues: []string{"d03", "", "bw"}, Tenant: "d03"}}, config.GetMetricData(context.Background(), 2, 2))
+
+	// matching tenants are not affected
+	config.Tenants[0].Tags = []string{"erp"}
+	assert.True(config.MetricApplies(2, 0))
+
+	// histograms and summaries have no plain value for the sentinel
+	assert.Nil(config.ValidateMetrics())
+	config.Metrics[2].MetricType = "histogram"
+	assert.NotNil(config.ValidateMetrics())
+	config.Metrics[2].MetricType = "summary"
+	assert.NotNil(config.ValidateMetrics())
 }
 
 func Test_GetSelection(t *testing.T) {
@@ -132,6 +2888,138 @@ func Test_GetSelection(t *testing.T) {
 	assert.Equal(res, "select count(*) from sys.m_blocked_transactions")
 }
 
+func Test_MetricSQL(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(2, 3)
+	for i := range config.Tenants {
+		config.Tenants[i].Schemas = []string{"sys"}
+	}
+
+	// the second tenant overrides the sql of m1, the others use the default
+	config.Tenants[1].MetricSQL = map[string]string{"M1": " select count(*) from <SCHEMA>.m_blocked_transactions_ext"}
+	assert.Nil(config.ValidateMetrics())
+	assert.Equal("select count(*) from sys.m_blocked_transactions", config.GetSelection(0, 0))
+	assert.Equal("select count(*) from sys.m_blocked_transactions_ext", config.GetSelection(0, 1))
+	assert.Equal("select count(*) from sys.m_blocked_transactions", config.GetSelection(0, 2))
+	assert.Equal(config.Metrics[1].SQL, config.MetricSQL(1, 1))
+
+	// only selects of known metrics
+	config.Tenants[1].MetricSQL = map[string]string{"m1": "delete from sys.m_blocked_transactions"}
+	assert.NotNil(config.ValidateMetrics())
+	assert.Equal("", config.GetSelection(0, 1))
+	config.Tenants[1].MetricSQL = map[string]string{"m9": "select 1 from dummy"}
+	assert.NotNil(config.ValidateMetrics())
+}
+
+func Test_AllowedSchemas(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Tenants[0].Schemas = []string{"sapabap1", "sys"}
+	config.Metrics[0].SchemaFilter = []string{"sapabap1"}
+
+	// all schemas are allowed by default
+	assert.Equal("select count(*) from sapabap1.m_blocked_transactions", config.GetSelection(0, 0))
+
+	// a disallowed schema is blocked
+	config.AllowedSchemas = []string{"SYS"}
+	assert.Equal("", config.GetSelection(0, 0))
+	stats := config.ErrorCountMetrics().Stats
+	assert.Equal(1, len(stats))
+	assert.Equal([]string{"m1", "d01", "schema_not_allowed"}, stats[0].LabelValues)
+
+	config.Metrics[0].SchemaFilter = []string{"sys"}
+	assert.Equal("select count(*) from sys.m_blocked_transactions", config.GetSelection(0, 0))
+}
+
+func Test_AllowedProcedures(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	config.Tenants[0].Schemas = []string{"monitoring", "sys"}
+	config.Metrics[0].SchemaFilter = []string{"monitoring"}
+	config.Metrics[0].SQL = "call <SCHEMA>.get_alerts('OPEN')"
+	config.SetConnections(0, openNamedMockDB(t, "procedure"), nil)
+	setNamedMockResult("procedure", "call monitoring.get_alerts('OPEN')", []string{"alerts", "rating"},
+		[]driver.Value{int64(4), "high"},
+		[]driver.Value{int64(9), "low"},
+	)
+
+	// calls are blocked by default
+	assert.Equal("", config.GetSelection(0, 0))
+	assert.Nil(config.GetMetricData(context.Background(), 0, 0))
+	stats := config.ErrorCountMetrics().Stats
+	assert.Equal([]string{"m1", "d01", "procedure_not_allowed"}, stats[0].LabelValues)
+
+	// the result set of an allowed procedure is processed like a select
+	config.AllowedProcedures = []string{"Monitoring.GET_ALERTS"}
+	assert.Equal("call monitoring.get_alerts('OPEN')", config.GetSelection(0, 0))
+	md := config.GetMetricData(context.Background(), 0, 0)
+	assert.Equal(2, len(md))
+	assert.Equal(4.0, md[0].Value)
+	assert.Equal([]string{"tenant", "usage", "rating"}, md[0].Labels)
+	assert.Equal("high", md[0].LabelValues[2])
+
+	// other procedures and further statements stay blocked
+	config.Metrics[0].SQL = "call monitoring.reset_alerts()"
+	assert.Equal("", config.GetSelection(0, 0))
+	config.Metrics[0].SQL = "call monitoring.get_alerts(); delete from monitoring.alerts"
+	assert.Equal("", config.GetSelection(0, 0))
+	assert.False(cmd.IsProcedureCall("call monitoring.get_alerts(); delete from monitoring.alerts"))
+	assert.True(cmd.IsProcedureCall(`CALL "MONITORING"."GET_ALERTS";`))
+	assert.Equal(`"MONITORING"."GET_ALERTS"`, cmd.ProcedureName(`CALL "MONITORING"."GET_ALERTS"`))
+	assert.Equal(`"MONITORING"."GET_ALERTS"`, cmd.ProcedureName("call Monitoring.Get_Alerts()"))
+
+	// quoted identifiers are case sensitive and keep dots in the name
+	config.Metrics[0].SQL = `CALL "MONITORING"."GET_ALERTS"('OPEN')`
+	assert.NotEqual("", config.GetSelection(0, 0))
+	config.Metrics[0].SQL = `call "monitoring"."get_alerts"('OPEN')`
+	assert.Equal("", config.GetSelection(0, 0))
+	config.Metrics[0].SQL = `call "MONITORING.GET_ALERTS"('OPEN')`
+	assert.Equal("", config.GetSelection(0, 0))
+	assert.Equal(`"MONITORING.GET_ALERTS"`, cmd.ProcedureName(`call "MONITORING.GET_ALERTS"`))
+	config.AllowedProcedures = []string{`"monitoring"."get_alerts"`}
+	config.Metrics[0].SQL = `call "monitoring"."get_alerts"('OPEN')`
+	assert.NotEqual("", config.GetSelection(0, 0))
+	config.Metrics[0].SQL = "call monitoring.get_alerts('OPEN')"
+	assert.Equal("", config.GetSelection(0, 0))
+	assert.False(cmd.IsProcedureCall("update sys.users set x = 1"))
+}
+
+func Test_IsSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(cmd.IsSelect("SELECT count(*) from sys.m_blocked_transactions"))
+	assert.False(cmd.IsSelect("delete from sys.m_blocked_transactions"))
+	assert.False(cmd.IsSelect("sel"))
+
+	// common table expressions without modifying statements
+	cte := "with blocked as (select * from sys.m_blocked_transactions) select count(*) from blocked"
+	assert.True(cmd.IsSelect(cte))
+	assert.True(cmd.IsSelect("WITH\n\tlast_updates as (select max(last_update_time) from m_tables) select * from last_updates"))
+	assert.False(cmd.IsSelect("with t as (select 1 from dummy) delete from sys.users"))
+	assert.False(cmd.IsSelect("with t as (select 1 from dummy) insert into a select * from t"))
+	assert.False(cmd.IsSelect("without_cte"))
+
+	// leading comments are ignored
+	assert.True(cmd.IsSelect("/* blocked transactions */ select count(*) from sys.m_blocked_transactions"))
+	assert.True(cmd.IsSelect("-- blocked\n  /* transactions\n */\n" + cte))
+	assert.False(cmd.IsSelect("/* select */ drop table t"))
+	assert.False(cmd.IsSelect("/* unterminated select count(*) from dummy"))
+	assert.Equal("select 1 from dummy", cmd.StripComments(" -- one\n/**/select 1 from dummy"))
+	assert.True(cmd.IsProcedureCall("/* alerts */ call monitoring.get_alerts()"))
+
+	// selections and gates accept them
+	config := getTestConfig(1, 1)
+	config.Metrics[0].SQL = "/* blocked */ " + cte
+	assert.Equal(config.Metrics[0].SQL, config.GetSelection(0, 0))
+	config.Tenants[0].MetricSQL = map[string]string{"m1": "-- tenant\n" + cte}
+	assert.Nil(config.ValidateMetrics())
+	db := openNamedMockDB(t, "cte")
+	setNamedMockResult("cte", "with t as (select 1 from dummy) select * from t", []string{"X"}, []driver.Value{int64(1)})
+	open, err := cmd.GateOpen(context.Background(), db, "with t as (select 1 from dummy) select * from t")
+	assert.Nil(err)
+	assert.True(open)
+}
+
 func Test_AdaptSchemaFilter(t *testing.T) {
 
 	var mi = []cmd.MetricInfo{
@@ -214,3 +3102,59 @@ func Test_FirstValueInSclice(t *testing.T) {
 	b := cmd.FirstValueInSlice([]string{"s1", "s2"}, []string{})
 	assert.Equal(b, "")
 }
+
+func Test_ValueColumns(t *testing.T) {
+	assert := assert.New(t)
+	config := getTestConfig(1, 1)
+	ti := config.Tenants[0]
+	db := openMockDB(t)
+	defer db.Close()
+
+	query := "select host, used_memory, free_memory from sys.m_host_resource_utilization"
+	setMockResult(query, []string{"HOST", "USED_MEMORY", "FREE_MEMORY"},
+		[]driver.Value{"hana1", int64(100), int64(300)},
+		[]driver.Value{"hana2", int64(200), int64(400)},
+	)
+
+	// one record per value column and row with the column as suffix
+	config.Metrics[0].ValueColumns = []string{"used_memory", "FREE_MEMORY"}
+	assert.Nil(config.ValidateMetrics())
+	rows, err := db.Query(query)
+	assert.Nil(err)
+	md, err := ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.Nil(err)
+	rows.Close()
+	labels := []string{"tenant", "usage", "host"}
+	assert.Equal([]cmd.MetricRecord{
+		{Value: 100, Labels: labels, LabelValues: []string{"d01", "", "hana1"}, Suffix: "used_memory"},
+		{Value: 300, Labels: labels, LabelValues: []string{"d01", "", "hana1"}, Suffix: "free_memory"},
+		{Value: 200, Labels: labels, LabelValues: []string{"d01", "", "hana2"}, Suffix: "used_memory"},
+		{Value: 400, Labels: labels, LabelValues: []string{"d01", "", "hana2"}, Suffix: "free_memory"},
+	}, md)
+	assert.Equal("m1_free_memory", md[1].MetricName("m1"))
+	assert.Equal("p_m1_free_memory", cmd.MetricRecord{Prefix: "p", Suffix: "free_memory"}.MetricName("m1"))
+
+	// label values of the records are independent of each other
+	md[0].LabelValues[2] = "changed"
+	assert.Equal("hana1", md[1].LabelValues[2])
+
+	// unknown value column
+	config.Metrics[0].ValueColumns = []string{"used_memory", "total_memory"}
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+
+	// label columns can't be value columns
+	config.Metrics[0].ValueColumns = []string{"host"}
+	rows, err = db.Query(query)
+	assert.Nil(err)
+	_, err = ti.GetMetricRows(rows, &config.Metrics[0])
+	assert.NotNil(err)
+	rows.Close()
+
+	config.Metrics[0].ValueColumns = []string{"used_memory"}
+	config.Metrics[0].ValueColumn = "free_memory"
+	assert.NotNil(config.ValidateMetrics())
+}
@@ -15,19 +15,17 @@
 package main
 
 import (
-	"github.com/ulranh/hana_sql_exporter/cmd"
+	"fmt"
+	"os"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/ulranh/hana_sql_exporter/cmd"
 )
 
 func main() {
-	Formatter := new(log.TextFormatter)
-	Formatter.TimestampFormat = "02-01-2006 15:04:05"
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors:   true,
-		FullTimestamp:   true,
-		TimestampFormat: "02-01-2006 15:04:05",
-	})
+	if err := cmd.SetLogFormat("text"); err != nil {
+		fmt.Println("Log format can't be set: ", err)
+		os.Exit(1)
+	}
 
 	cmd.Execute()
 }